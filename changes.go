@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ChangeTracker remembers the last stored values of every key of a table, so only the
+// rows whose values changed are stored. A row is stored regardless of its values once
+// the keyframe interval has elapsed since the last stored row of its key.
+type ChangeTracker struct {
+	sync.Mutex
+	Key              map[string]bool
+	KeyframeInterval time.Duration
+	last             map[string]storedRow
+}
+
+type storedRow struct {
+	signature string
+	at        time.Time
+}
+
+// NewChangeTracker returns the tracker of a table, or nil if store-on-change is disabled.
+func NewChangeTracker(config ChangeConfig) (*ChangeTracker, error) {
+	if !config.StoreOnChange {
+		return nil, nil
+	}
+	interval, err := time.ParseDuration(config.KeyframeInterval)
+	if err != nil {
+		return nil, err
+	}
+	tracker := ChangeTracker{Key: make(map[string]bool), KeyframeInterval: interval, last: make(map[string]storedRow)}
+	for _, name := range config.Key {
+		tracker.Key[name] = true
+	}
+	return &tracker, nil
+}
+
+// Changed reports whether the row, given as the values of the fields, has to be stored at
+// the given time. Timestamp fields are not compared. The row is only remembered by Store,
+// once it was queued.
+func (tracker *ChangeTracker) Changed(fields []MapValueField, values []interface{}, at time.Time) bool {
+	key, row := tracker.row(fields, values, at)
+	tracker.Lock()
+	defer tracker.Unlock()
+	last, ok := tracker.last[key]
+	return !ok || last.signature != row.signature ||
+		(tracker.KeyframeInterval > 0 && at.Sub(last.at) >= tracker.KeyframeInterval)
+}
+
+// Store remembers the row as the last stored one of its key.
+func (tracker *ChangeTracker) Store(fields []MapValueField, values []interface{}, at time.Time) {
+	key, row := tracker.row(fields, values, at)
+	tracker.Lock()
+	defer tracker.Unlock()
+	tracker.last[key] = row
+}
+
+// Forget removes the row if it is still the last stored one of its key, as it was dropped
+// from the insert queue, so the next row of the key is stored regardless of its values.
+func (tracker *ChangeTracker) Forget(fields []MapValueField, values []interface{}, at time.Time) {
+	key, row := tracker.row(fields, values, at)
+	tracker.Lock()
+	defer tracker.Unlock()
+	if tracker.last[key] == row {
+		delete(tracker.last, key)
+	}
+}
+
+// row returns the key of the row and the signature of its compared values.
+func (tracker *ChangeTracker) row(fields []MapValueField, values []interface{}, at time.Time) (string, storedRow) {
+	var key, signature []string
+	for i, field := range fields {
+		if tracker.Key[field.Name] {
+			key = append(key, fmt.Sprint(values[i]))
+		} else if !field.Timestamp {
+			signature = append(signature, fmt.Sprint(values[i]))
+		}
+	}
+	return strings.Join(key, "\x00"), storedRow{signature: strings.Join(signature, "\x00"), at: at}
+}
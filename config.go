@@ -10,32 +10,107 @@ import (
 	"gopkg.in/yaml.v2"
 	"io/ioutil"
 	"net/url"
+	"regexp"
 	"sort"
 	"strconv"
 	"strings"
+	"time"
+)
+
+const (
+	// TimestampEpoch parses timestamp fields as seconds since the epoch, with optional decimals.
+	TimestampEpoch = "epoch"
+	// TimestampEpochMs parses timestamp fields as milliseconds since the epoch.
+	TimestampEpochMs = "epoch-ms"
 )
 
 type MapValueField struct {
-	Name  string `yaml:"name"`
-	Type  string `yaml:"type" default:""`
-	Index int    `yaml:"field-index"`
+	Name        string `yaml:"name"`
+	Type        string `yaml:"type" default:""`
+	Index       int    `yaml:"field-index"`
+	Timestamp   bool   `yaml:"timestamp,omitempty"`
+	Layout      string `yaml:"layout,omitempty"`
+	Description string `yaml:"description,omitempty"`
+	Unit        string `yaml:"unit,omitempty"`
+}
+
+// Time parses the value of a timestamp field using its layout, the go reference time
+// layout (RFC3339 by default), epoch or epoch-ms. Values without a zone are local times,
+// values without a date (e.g: 15:04:05) take the date of the collection time, and values
+// without a year (e.g: Jan _2 15:04:05) take the year of the collection time.
+func (field *MapValueField) Time(values []string, collectedAt time.Time) (time.Time, error) {
+	if field.Index >= len(values) {
+		return time.Time{}, fmt.Errorf("missing value for timestamp field: %s", field.Name)
+	}
+	value := values[field.Index]
+
+	switch field.Layout {
+	case TimestampEpoch:
+		seconds, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid epoch timestamp for field %s: %s", field.Name, value)
+		}
+		return time.Unix(0, int64(seconds*float64(time.Second))), nil
+	case TimestampEpochMs:
+		milliseconds, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid epoch-ms timestamp for field %s: %s", field.Name, value)
+		}
+		return time.Unix(0, milliseconds*int64(time.Millisecond)), nil
+	}
+
+	layout := field.Layout
+	if layout == "" {
+		layout = time.RFC3339
+	}
+	parsed, err := time.ParseInLocation(layout, value, collectedAt.Location())
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid timestamp for field %s: %s", field.Name, err)
+	}
+	if parsed.Year() != 0 {
+		return parsed, nil
+	}
+	year, month, day := collectedAt.Date()
+	if !layoutHasDate(layout) {
+		return time.Date(year, month, day, parsed.Hour(), parsed.Minute(), parsed.Second(), parsed.Nanosecond(),
+			parsed.Location()), nil
+	}
+	// only the year is missing (e.g: syslog), a date ahead of the collection is from the previous year.
+	parsed = time.Date(year, parsed.Month(), parsed.Day(), parsed.Hour(), parsed.Minute(), parsed.Second(),
+		parsed.Nanosecond(), parsed.Location())
+	if parsed.Sub(collectedAt) > 24*time.Hour {
+		parsed = parsed.AddDate(-1, 0, 0)
+	}
+	return parsed, nil
 }
 
-func (field *MapValueField) Format(values []string) string {
+// layoutHasDate reports whether the layout holds the month or the day of the time.
+func layoutHasDate(layout string) bool {
+	return time.Date(0, 2, 3, 0, 0, 0, 0, time.UTC).Format(layout) != time.Date(0, 1, 1, 0, 0, 0, 0, time.UTC).Format(layout)
+}
+
+// Value converts the matching output value to the type of the field, the value is
+// bound as a statement parameter so it is never interpreted as SQL.
+func (field *MapValueField) Value(values []string) interface{} {
+	var value string
+	if field.Index < len(values) {
+		value = values[field.Index]
+	}
 	switch field.Type {
-	case "string":
-		return "'" + values[field.Index] + "'"
 	case "int":
-		if len(values) < field.Index {
-			return "0"
+		parsed, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return int64(0)
 		}
-		_, err := strconv.Atoi(values[field.Index])
+		return parsed
+	case "float":
+		parsed, err := strconv.ParseFloat(value, 64)
 		if err != nil {
-			return "0"
+			return 0.0
 		}
-		return values[field.Index]
+		return parsed
 	default:
-		return values[field.Index]
+		return value
 	}
 }
 
@@ -52,56 +127,550 @@ func (mv *MapValue) SortFieldsByIndex() {
 	})
 }
 
-type DBConfig struct {
-	MapValues MapValue `yaml:"map-values,omitempty"`
-	Name      string   `yaml:"name,omitempty"`
-}
-
-func (c *DBConfig) SetDefaults() error {
-	c.MapValues.SortFieldsByIndex()
-	for i, f := range c.MapValues.Fields {
-		for j, ff := range c.MapValues.Fields {
+// Validate sorts the fields by index and checks their definitions.
+func (mv *MapValue) Validate() error {
+	mv.SortFieldsByIndex()
+	for i, f := range mv.Fields {
+		for j, ff := range mv.Fields {
 			if i != j && f.Name == ff.Name {
 				return fmt.Errorf("duplicate field name: %s - idx: %d and idx: %d, please rename one of them",
 					f.Name, i, j)
 			}
 		}
 	}
+	timestamps := 0
+	for _, f := range mv.Fields {
+		if f.Layout != "" && !f.Timestamp {
+			return fmt.Errorf("field: %s sets a layout, but it is not a timestamp field", f.Name)
+		}
+		if f.Timestamp {
+			timestamps++
+		}
+	}
+	if timestamps > 1 {
+		return fmt.Errorf("only one timestamp field is allowed, found: %d", timestamps)
+	}
+	return nil
+}
+
+// ValidIdentifier matches the table, column, index and view names accepted in the configuration.
+var ValidIdentifier = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// IsReservedTableName reports whether the table name is used by repeat or sqlite for
+// their own records, collections cannot store rows on these tables.
+func IsReservedTableName(name string) bool {
+	name = strings.ToLower(name)
+	return name == SessionsTableName || name == RunHistoryTableName ||
+		strings.HasPrefix(name, "_repeat_") || strings.HasPrefix(name, "sqlite_")
+}
+
+// BuiltinColumns are the columns added to every collection table.
+var BuiltinColumns = []string{"id", "created_at", "updated_at", "deleted_at", "session_id", "run_id"}
+
+// IndexConfig is an index created on a collection table.
+type IndexConfig struct {
+	Columns []string `yaml:"columns"`
+	Unique  bool     `yaml:"unique,omitempty"`
+}
+
+// Name returns the name of the index on the given table.
+func (index *IndexConfig) Name(tableName string) string {
+	prefix := "idx_"
+	if index.Unique {
+		prefix = "uidx_"
+	}
+	return prefix + tableName + "_" + strings.Join(index.Columns, "_")
+}
+
+func validateIndexes(indexes []IndexConfig, fields []MapValueField) error {
+	columns := make(map[string]bool)
+	for _, column := range BuiltinColumns {
+		columns[column] = true
+	}
+	for _, field := range fields {
+		columns[field.Name] = true
+	}
+	for i, index := range indexes {
+		if len(index.Columns) == 0 {
+			return fmt.Errorf("index at position: %d has no columns", i)
+		}
+		for _, column := range index.Columns {
+			if !columns[column] {
+				return fmt.Errorf("index at position: %d, unknown column: %s", i, column)
+			}
+		}
+	}
+	return nil
+}
+
+// ChangeConfig stores the rows of a table only when their values differ from the last
+// stored row with the same key, with a keyframe row stored every keyframe-interval.
+type ChangeConfig struct {
+	StoreOnChange    bool     `yaml:"store-on-change,omitempty"`
+	Key              []string `yaml:"key,omitempty"`
+	KeyframeInterval string   `yaml:"keyframe-interval" default:"1h"`
+}
+
+func (c *ChangeConfig) Validate(fields []MapValueField) error {
+	if !c.StoreOnChange {
+		if len(c.Key) > 0 {
+			return fmt.Errorf("key is only used along with store-on-change")
+		}
+		return nil
+	}
+	if _, err := time.ParseDuration(c.KeyframeInterval); err != nil {
+		return fmt.Errorf("invalid keyframe-interval: %s", err)
+	}
+	for _, name := range c.Key {
+		found := false
+		for _, field := range fields {
+			found = found || field.Name == name
+		}
+		if !found {
+			return fmt.Errorf("unknown key field: %s", name)
+		}
+	}
+	return nil
+}
+
+// ViewConfig is a SQL view created on the database at the end of the session.
+type ViewConfig struct {
+	Name string `yaml:"name"`
+	SQL  string `yaml:"sql"`
+}
+
+func (v *ViewConfig) Validate() error {
+	if !ValidIdentifier.MatchString(v.Name) {
+		return fmt.Errorf("invalid view name: %q, must contain only letters, digits and underscores", v.Name)
+	}
+	if strings.TrimSpace(v.SQL) == "" {
+		return fmt.Errorf("view: %s has no sql", v.Name)
+	}
+	return nil
+}
+
+// RollupConfig aggregates the numeric fields of a table into the min, max and average
+// of every interval, grouped by the key fields.
+type RollupConfig struct {
+	Table    string   `yaml:"table,omitempty"`
+	Interval string   `yaml:"interval" default:"1m"`
+	Key      []string `yaml:"key,omitempty"`
+	Fields   []string `yaml:"fields"`
+}
+
+func (c *RollupConfig) Validate(fields []MapValueField) error {
+	interval, err := time.ParseDuration(c.Interval)
+	if err != nil {
+		return fmt.Errorf("invalid rollup interval: %s", err)
+	}
+	if interval < time.Second || interval%time.Second != 0 {
+		return fmt.Errorf("invalid rollup interval: %s, must be a whole number of seconds", c.Interval)
+	}
+	if len(c.Fields) == 0 {
+		return fmt.Errorf("rollup every %s has no fields", c.Interval)
+	}
+	types := make(map[string]string)
+	for _, field := range fields {
+		if !field.Timestamp {
+			types[field.Name] = field.Type
+		}
+	}
+	for _, name := range c.Key {
+		if _, ok := types[name]; !ok {
+			return fmt.Errorf("unknown rollup key field: %s", name)
+		}
+	}
+	for _, name := range c.Fields {
+		fieldType, ok := types[name]
+		if !ok {
+			return fmt.Errorf("unknown rollup field: %s", name)
+		}
+		if fieldType != "int" && fieldType != "float" {
+			return fmt.Errorf("rollup field: %s must be of type int or float", name)
+		}
+	}
+	return nil
+}
+
+// TableConfig stores the output lines matching a regular expression into its own table,
+// so a single run of a command can populate several tables.
+type TableConfig struct {
+	Name      string        `yaml:"name"`
+	Match     string        `yaml:"match,omitempty"`
+	MapValues MapValue      `yaml:"map-values"`
+	Indexes   []IndexConfig `yaml:"indexes,omitempty"`
+	Changes   ChangeConfig  `yaml:",inline"`
+}
+
+type DBConfig struct {
+	MapValues MapValue       `yaml:"map-values,omitempty"`
+	Name      string         `yaml:"name,omitempty"`
+	Tables    []TableConfig  `yaml:"tables,omitempty"`
+	Indexes   []IndexConfig  `yaml:"indexes,omitempty"`
+	Changes   ChangeConfig   `yaml:",inline"`
+	Retention string         `yaml:"retention,omitempty"`
+	Rollup    []RollupConfig `yaml:"rollup,omitempty"`
+}
+
+// HasMaintenance reports whether the tables of the collection have a retention or rollups.
+func (c *DBConfig) HasMaintenance() bool {
+	return c.Retention != "" || len(c.Rollup) > 0
+}
+
+// validateMaintenance checks the retention and rollups of the collection, every rollup
+// refers to one of the tables when these are defined.
+func (c *DBConfig) validateMaintenance() error {
+	if c.Retention != "" {
+		if retention, err := time.ParseDuration(c.Retention); err != nil || retention <= 0 {
+			return fmt.Errorf("invalid retention: %s, must be a positive duration", c.Retention)
+		}
+	}
+
+	rollups := make(map[string]bool)
+	for i := range c.Rollup {
+		rollup := &c.Rollup[i]
+		if err := defaults.Set(rollup); err != nil {
+			return err
+		}
+		fields, changes := c.MapValues.Fields, c.Changes
+		if len(c.Tables) == 0 && rollup.Table != "" {
+			return fmt.Errorf("rollup table: %s can only be used along with tables", rollup.Table)
+		}
+		if len(c.Tables) > 0 {
+			found := false
+			for _, table := range c.Tables {
+				if strings.EqualFold(table.Name, rollup.Table) {
+					fields, changes, found = table.MapValues.Fields, table.Changes, true
+				}
+			}
+			if !found {
+				return fmt.Errorf("rollup at position: %d, unknown table: %q", i, rollup.Table)
+			}
+		}
+		if changes.StoreOnChange {
+			return fmt.Errorf("rollup cannot be used along with store-on-change, unchanged rows are not stored")
+		}
+		if err := rollup.Validate(fields); err != nil {
+			return err
+		}
+		id := strings.ToLower(rollup.Table) + "/" + rollup.Interval
+		if rollups[id] {
+			return fmt.Errorf("duplicate rollup every %s", rollup.Interval)
+		}
+		rollups[id] = true
+	}
+	return nil
+}
+
+// validateRetention checks the rows of every interval are rolled up before the retention
+// removes them: an interval is rolled up by the first maintenance pass once it ended longer
+// than the flush-interval ago, when its rows were inserted.
+func (c *Collection) validateRetention() error {
+	if c.Database.Retention == "" {
+		return nil
+	}
+	retention, _ := time.ParseDuration(c.Database.Retention)
+	flush, err := time.ParseDuration(c.Flush)
+	if err != nil {
+		return fmt.Errorf("invalid flush-interval: %s", err)
+	}
+	for _, rollup := range c.Database.Rollup {
+		interval, _ := time.ParseDuration(rollup.Interval)
+		if minimum := interval + flush + DefaultFlushCheckInterval + DefaultMaintenanceInterval; retention < minimum {
+			return fmt.Errorf("retention: %s must be at least %s with a rollup interval of %s, rows would be removed before they are rolled up",
+				c.Database.Retention, minimum, rollup.Interval)
+		}
+	}
 	return nil
 }
 
+func (c *DBConfig) SetDefaults() error {
+	if err := c.MapValues.Validate(); err != nil {
+		return err
+	}
+	if len(c.Tables) > 0 && (len(c.MapValues.Fields) > 0 || c.Name != "" || len(c.Indexes) > 0 || c.Changes.StoreOnChange) {
+		return fmt.Errorf("map-values, name, indexes and store-on-change cannot be combined with tables, define them on each table")
+	}
+	if c.Name != "" && !ValidIdentifier.MatchString(c.Name) {
+		return fmt.Errorf("invalid table name: %q, must contain only letters, digits and underscores", c.Name)
+	}
+	if c.Name != "" && IsReservedTableName(c.Name) {
+		return fmt.Errorf("table name: %s is reserved", c.Name)
+	}
+	if err := validateIndexes(c.Indexes, c.MapValues.Fields); err != nil {
+		return err
+	}
+	if err := c.Changes.Validate(c.MapValues.Fields); err != nil {
+		return err
+	}
+	names := make(map[string]bool)
+	for i := range c.Tables {
+		table := &c.Tables[i]
+		if !ValidIdentifier.MatchString(table.Name) {
+			return fmt.Errorf("invalid name: %q for table at position: %d, must contain only letters, digits and underscores", table.Name, i)
+		}
+		if IsReservedTableName(table.Name) {
+			return fmt.Errorf("table name: %s is reserved", table.Name)
+		}
+		if names[strings.ToLower(table.Name)] {
+			return fmt.Errorf("duplicate table name: %s", table.Name)
+		}
+		names[strings.ToLower(table.Name)] = true
+		if _, err := regexp.Compile(table.Match); err != nil {
+			return fmt.Errorf("table: %s, invalid match expression: %s", table.Name, err)
+		}
+		if err := defaults.Set(table); err != nil {
+			return err
+		}
+		if err := table.MapValues.Validate(); err != nil {
+			return fmt.Errorf("table: %s, %s", table.Name, err)
+		}
+		if err := validateIndexes(table.Indexes, table.MapValues.Fields); err != nil {
+			return fmt.Errorf("table: %s, %s", table.Name, err)
+		}
+		if err := table.Changes.Validate(table.MapValues.Fields); err != nil {
+			return fmt.Errorf("table: %s, %s", table.Name, err)
+		}
+	}
+	return c.validateMaintenance()
+}
+
+const (
+	// OverlapSkip drops a run if the previous run of the same collection is still in progress.
+	OverlapSkip = "skip"
+	// OverlapQueue waits for the previous run to finish, keeping at most one pending run.
+	OverlapQueue = "queue"
+	// OverlapAllow starts a new run regardless of the previous ones.
+	OverlapAllow = "allow"
+)
+
+const (
+	// ModeRun runs the command to completion on every tick.
+	ModeRun = "run"
+	// ModeStream starts the command once and processes its output line by line.
+	ModeStream = "stream"
+)
+
+type StreamConfig struct {
+	RestartDelay string `yaml:"restart-delay" default:"1s"`
+	RotateSize   string `yaml:"rotate-size" default:"10MB"`
+}
+
+type RlimitsConfig struct {
+	CPU          int    `yaml:"cpu" default:"0"`
+	AddressSpace string `yaml:"address-space,omitempty"`
+	OpenFiles    int    `yaml:"open-files" default:"0"`
+}
+
+type CgroupConfig struct {
+	MemoryMax string `yaml:"memory-max,omitempty"`
+	CPUMax    string `yaml:"cpu-max,omitempty"`
+}
+
+type CircuitBreakerConfig struct {
+	Failures   int    `yaml:"failures" default:"0"`
+	ProbeAfter string `yaml:"probe-after" default:"1m"`
+}
+
 type Collection struct {
 	Command   string   `yaml:"command"`
 	RunEvery  string   `yaml:"run-every" default:"0s"`
 	Timeout   string   `yaml:"timeout" default:"0s"`
+	Grace     string   `yaml:"grace-period" default:"5s"`
 	BatchSize int      `yaml:"batch-size" default:"1"`
+	Flush     string   `yaml:"flush-interval" default:"5s"`
 	RunOnce   bool     `yaml:"run-once" default:"false"`
 	Script    string   `yaml:"script"`
 	ExitCodes string   `yaml:"exit-codes" default:"any"`
 	Store     string   `yaml:"store" default:"file"`
+	Overlap   string   `yaml:"overlap" default:"skip"`
 	Database  DBConfig `yaml:"database"`
+
+	Retries        int                  `yaml:"retries" default:"0"`
+	RetryBackoff   string               `yaml:"retry-backoff" default:"1s"`
+	CircuitBreaker CircuitBreakerConfig `yaml:"circuit-breaker"`
+	MergeStderr    bool                 `yaml:"merge-stderr" default:"false"`
+	Mode           string               `yaml:"mode" default:"run"`
+	Stream         StreamConfig         `yaml:"stream"`
+	MaxOutput      string               `yaml:"max-output" default:"0"`
+	OnMaxOutput    string               `yaml:"on-max-output" default:"truncate"`
+	Argv           []string             `yaml:"argv,omitempty"`
+	Interpreter    string               `yaml:"interpreter,omitempty"`
+	Nice           int                  `yaml:"nice" default:"0"`
+	IONice         string               `yaml:"ionice,omitempty"`
+	Rlimits        RlimitsConfig        `yaml:"rlimits"`
+	Cgroup         CgroupConfig         `yaml:"cgroup"`
+	User           string               `yaml:"user,omitempty"`
+	Group          string               `yaml:"group,omitempty"`
+	Description    string               `yaml:"description,omitempty"`
+	Unit           string               `yaml:"unit,omitempty"`
 }
 
 func (c *Collection) SetDefaults() error {
 	if err := defaults.Set(c); err != nil {
 		return err
 	}
-	if c.Command != "" && c.Script != "" {
-		return fmt.Errorf("command or script stanzas are mutually exclusive")
+	stanzas := 0
+	for _, defined := range []bool{c.Command != "", c.Script != "", len(c.Argv) > 0} {
+		if defined {
+			stanzas++
+		}
+	}
+	if stanzas > 1 {
+		return fmt.Errorf("command, script or argv stanzas are mutually exclusive")
+	}
+	if c.Interpreter != "" && c.Script == "" {
+		return fmt.Errorf("interpreter can only be used along with a script stanza")
+	}
+
+	switch c.Overlap {
+	case OverlapSkip, OverlapQueue, OverlapAllow:
+	default:
+		return fmt.Errorf("invalid overlap policy: %s, must be one of: %s, %s, %s",
+			c.Overlap, OverlapSkip, OverlapQueue, OverlapAllow)
+	}
+
+	switch c.Mode {
+	case ModeRun:
+	case ModeStream:
+		if c.RunOnce {
+			return fmt.Errorf("mode: %s cannot be used with run-once", ModeStream)
+		}
+		if _, err := ParseSize(c.Stream.RotateSize); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("invalid mode: %s, must be one of: %s, %s", c.Mode, ModeRun, ModeStream)
+	}
+
+	if _, err := ParseExitCodes(c.ExitCodes); err != nil {
+		return err
+	}
+
+	if _, err := NewProcessLimits(*c); err != nil {
+		return err
 	}
 
-	if len(c.Database.MapValues.Fields) > 0 {
+	if _, err := ParseSize(c.MaxOutput); err != nil {
+		return err
+	}
+	if c.OnMaxOutput != MaxOutputTruncate && c.OnMaxOutput != MaxOutputAbort {
+		return fmt.Errorf("invalid on-max-output: %s, must be one of: %s, %s",
+			c.OnMaxOutput, MaxOutputTruncate, MaxOutputAbort)
+	}
+
+	if c.Retries < 0 || c.CircuitBreaker.Failures < 0 {
+		return fmt.Errorf("retries and circuit-breaker failures must be positive numbers")
+	}
+
+	if len(c.Database.MapValues.Fields) > 0 || len(c.Database.Tables) > 0 || c.Database.Name != "" ||
+		c.Database.Changes.StoreOnChange || c.Database.HasMaintenance() {
 		if err := c.Database.SetDefaults(); err != nil {
 			return err
 		}
+		if err := c.validateRetention(); err != nil {
+			return err
+		}
 	}
 
 	return nil
 }
 
+const (
+	// QueueBlock makes the collectors wait for room on a full insert queue.
+	QueueBlock = "block"
+	// QueueDropOldest discards the oldest queued record to make room for the new one.
+	QueueDropOldest = "drop-oldest"
+	// QueueDropNewest discards the new record when the insert queue is full.
+	QueueDropNewest = "drop-newest"
+)
+
+// QueueConfig bounds the records waiting to be inserted into the database.
+type QueueConfig struct {
+	Size   int    `yaml:"size" default:"100000"`
+	Policy string `yaml:"policy" default:"block"`
+}
+
+func (c *QueueConfig) SetDefaults() error {
+	if err := defaults.Set(c); err != nil {
+		return err
+	}
+	if c.Size <= 0 {
+		return fmt.Errorf("invalid queue size: %d, must be greater than 0", c.Size)
+	}
+	switch c.Policy {
+	case QueueBlock, QueueDropOldest, QueueDropNewest:
+	default:
+		return fmt.Errorf("invalid queue policy: %s, must be one of: %s, %s, %s", c.Policy,
+			QueueBlock, QueueDropOldest, QueueDropNewest)
+	}
+	return nil
+}
+
 type Config struct {
 	Collections map[string]Collection `yaml:"collections"`
 	Imports     []string              `yaml:"import,omitempty"`
+	Queue       QueueConfig           `yaml:"queue"`
+	Views       []ViewConfig          `yaml:"views,omitempty"`
+}
+
+// TableNames returns the tables the collection stores rows on, its rollup tables included.
+func (c *Collection) TableNames(name string) []string {
+	var tables []string
+	if len(c.Database.Tables) > 0 {
+		for _, table := range c.Database.Tables {
+			tables = append(tables, strings.ToLower(table.Name))
+		}
+	} else if c.Database.Name != "" {
+		tables = append(tables, strings.ToLower(c.Database.Name))
+	} else {
+		tables = append(tables, strings.ToLower(name))
+	}
+	for _, rollup := range c.Database.Rollup {
+		table := tables[0]
+		if rollup.Table != "" {
+			table = strings.ToLower(rollup.Table)
+		}
+		tables = append(tables, RollupTableName(table, rollup.Interval))
+	}
+	return tables
+}
+
+// ValidateTables rejects collections storing rows on the tables of repeat, or on the
+// tables of another collection.
+func (c *Config) ValidateTables() error {
+	var names []string
+	for name := range c.Collections {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	owners := make(map[string]string)
+	for _, name := range names {
+		collection := c.Collections[name]
+		if collection.Store != "database" {
+			continue
+		}
+		for _, table := range collection.TableNames(name) {
+			if IsReservedTableName(table) {
+				return fmt.Errorf("collection: %s, table name: %s is reserved, set database.name", name, table)
+			}
+			if owner, ok := owners[table]; ok {
+				return fmt.Errorf("collections: %s and %s cannot store rows on the same table: %s", owner, name, table)
+			}
+			owners[table] = name
+		}
+	}
+	return nil
+}
+
+func (c *Config) HasView(name string) bool {
+	for _, view := range c.Views {
+		if view.Name == name {
+			return true
+		}
+	}
+	return false
 }
 
 func fetchImport(importURL string) ([]byte, error) {
@@ -184,6 +753,14 @@ func LoadConfig(config *Config, urlFetcher func(url string) ([]byte, error)) err
 			config.Collections[name] = collection
 		}
 
+		for _, view := range importedConfig.Views {
+			if config.HasView(view.Name) {
+				log.Warnf("view with name %s already exists, not added", view.Name)
+				continue
+			}
+			config.Views = append(config.Views, view)
+		}
+
 		LoadedImports[importUrl] = true
 	}
 
@@ -215,5 +792,19 @@ func NewConfigFromFile(path string) (*Config, error) {
 		return nil, err
 	}
 
+	if err := config.Queue.SetDefaults(); err != nil {
+		return nil, err
+	}
+
+	if err := config.ValidateTables(); err != nil {
+		return nil, err
+	}
+
+	for _, view := range config.Views {
+		if err := view.Validate(); err != nil {
+			return nil, err
+		}
+	}
+
 	return &config, nil
 }
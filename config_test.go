@@ -64,3 +64,135 @@ func TestLoadConfigMultipleImports(t *testing.T) {
 	assert.NotNil(t, config)
 	assert.Len(t, config.Collections, 4)
 }
+
+func TestCollectionInvalidOverlapPolicy(t *testing.T) {
+	collection := Collection{Command: "ps aux", Overlap: "sometimes"}
+	assert.Error(t, collection.SetDefaults())
+
+	collection = Collection{Command: "ps aux"}
+	assert.Nil(t, collection.SetDefaults())
+	assert.Equal(t, OverlapSkip, collection.Overlap)
+}
+
+func TestDBConfigTimestampFields(t *testing.T) {
+	config := DBConfig{MapValues: MapValue{Fields: []MapValueField{
+		{Name: "time", Index: 0, Timestamp: true, Layout: TimestampEpoch},
+		{Name: "value", Index: 1, Type: "int"},
+	}}}
+	assert.Nil(t, config.SetDefaults())
+
+	config.MapValues.Fields[1].Layout = "15:04:05"
+	assert.Error(t, config.SetDefaults())
+
+	config.MapValues.Fields[1].Timestamp = true
+	assert.Error(t, config.SetDefaults())
+}
+
+func TestDBConfigTables(t *testing.T) {
+	table := TableConfig{Name: "tcp", Match: "^TCP:", MapValues: MapValue{Fields: []MapValueField{{Name: "inuse", Index: 2}}}}
+	config := DBConfig{Tables: []TableConfig{table}}
+	assert.Nil(t, config.SetDefaults())
+	assert.Equal(t, ",", config.Tables[0].MapValues.Separator)
+
+	assert.Error(t, (&DBConfig{Tables: []TableConfig{table, table}}).SetDefaults())
+	assert.Error(t, (&DBConfig{Tables: []TableConfig{{Name: "bad", Match: "("}}}).SetDefaults())
+	assert.Error(t, (&DBConfig{Tables: []TableConfig{table}, MapValues: table.MapValues}).SetDefaults())
+}
+
+func TestDBConfigNameAndIndexes(t *testing.T) {
+	fields := MapValue{Fields: []MapValueField{{Name: "pid", Index: 1}}}
+	assert.Nil(t, (&DBConfig{Name: "processes", MapValues: fields, Indexes: []IndexConfig{{Columns: []string{"pid", "run_id"}}}}).SetDefaults())
+	assert.Error(t, (&DBConfig{Name: "bad name", MapValues: fields}).SetDefaults())
+	assert.Error(t, (&DBConfig{MapValues: fields, Indexes: []IndexConfig{{Columns: []string{"rss"}}}}).SetDefaults())
+	assert.Error(t, (&DBConfig{MapValues: fields, Indexes: []IndexConfig{{}}}).SetDefaults())
+
+	assert.Error(t, (&ViewConfig{Name: "v", SQL: " "}).Validate())
+	assert.Error(t, (&ViewConfig{Name: "drop table", SQL: "SELECT 1"}).Validate())
+}
+
+func TestDBConfigStoreOnChange(t *testing.T) {
+	var collection Collection
+	assert.Nil(t, yaml.Unmarshal([]byte(`
+command: ip -o link
+store: database
+database:
+  store-on-change: true
+  key: [interface]
+  map-values:
+    fields:
+      - name: interface
+        field-index: 1
+      - name: mtu
+        type: int
+        field-index: 4
+`), &collection))
+	assert.Nil(t, collection.SetDefaults())
+	assert.True(t, collection.Database.Changes.StoreOnChange)
+	assert.Equal(t, "1h", collection.Database.Changes.KeyframeInterval)
+
+	collection.Database.Changes.Key = []string{"name"}
+	assert.Error(t, collection.Database.SetDefaults())
+
+	collection.Database.Changes = ChangeConfig{Key: []string{"interface"}}
+	assert.Error(t, collection.Database.SetDefaults())
+}
+
+func TestDBConfigRetentionAndRollup(t *testing.T) {
+	var collection Collection
+	assert.Nil(t, yaml.Unmarshal([]byte(`
+command: ps aux
+store: database
+database:
+  retention: 1h
+  rollup:
+    - key: [command]
+      fields: [cpu, rss]
+  map-values:
+    fields:
+      - name: cpu
+        type: float
+        field-index: 2
+      - name: rss
+        type: int
+        field-index: 5
+      - name: command
+        field-index: 10
+`), &collection))
+	assert.Nil(t, collection.SetDefaults())
+	assert.Equal(t, "1m", collection.Database.Rollup[0].Interval)
+
+	collection.Database.Rollup[0].Fields = []string{"command"}
+	assert.Error(t, collection.Database.SetDefaults())
+
+	// the rows of an interval must be kept until the interval is rolled up.
+	collection.Database.Rollup[0] = RollupConfig{Interval: "1h", Fields: []string{"rss"}}
+	assert.Nil(t, collection.Database.SetDefaults())
+	assert.Error(t, collection.SetDefaults())
+	collection.Database.Rollup[0] = RollupConfig{Interval: "55m", Fields: []string{"rss"}}
+	assert.Nil(t, collection.SetDefaults())
+
+	collection.Database.Rollup[0] = RollupConfig{Interval: "1.5s", Fields: []string{"rss"}}
+	assert.Error(t, collection.Database.SetDefaults())
+
+	collection.Database.Rollup[0] = RollupConfig{Table: "processes", Fields: []string{"rss"}}
+	assert.Error(t, collection.Database.SetDefaults())
+}
+
+func TestConfigValidateTables(t *testing.T) {
+	fields := MapValue{Fields: []MapValueField{{Name: "pid", Index: 1}}}
+	assert.Error(t, (&DBConfig{Name: "run_history", MapValues: fields}).SetDefaults())
+	assert.Error(t, (&DBConfig{Tables: []TableConfig{{Name: "_repeat_columns", MapValues: fields}}}).SetDefaults())
+
+	config := Config{Collections: map[string]Collection{
+		"processes": {Store: "database", Database: DBConfig{MapValues: fields}},
+		"ps":        {Store: "database", Database: DBConfig{Name: "Processes", MapValues: fields}},
+		"files":     {Store: "file", Database: DBConfig{Name: "processes"}},
+	}}
+	assert.Error(t, config.ValidateTables())
+
+	delete(config.Collections, "ps")
+	assert.Nil(t, config.ValidateTables())
+
+	config.Collections["sessions"] = Collection{Store: "database", Database: DBConfig{MapValues: fields}}
+	assert.Error(t, config.ValidateTables())
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"syscall"
+)
+
+// Geteuid and Getegid return the identity repeat runs as.
+var Geteuid, Getegid = os.Geteuid, os.Getegid
+
+// LookupCredential resolves the user and group a collector runs as. The group
+// defaults to the primary group of the user, and the current user is kept if
+// only the group is given.
+func LookupCredential(userName, groupName string) (*syscall.Credential, error) {
+	var credential syscall.Credential
+	var target *user.User
+	var err error
+
+	if userName == "" && groupName == "" {
+		return nil, nil
+	}
+
+	if userName != "" {
+		target, err = user.Lookup(userName)
+		if _, ok := err.(user.UnknownUserError); ok {
+			target, err = user.LookupId(userName)
+		}
+	} else {
+		target, err = user.Current()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot find user: %s, %s", userName, err)
+	}
+
+	uid, err := strconv.ParseUint(target.Uid, 10, 32)
+	if err != nil {
+		return nil, err
+	}
+	credential.Uid = uint32(uid)
+
+	gid := target.Gid
+	if groupName != "" {
+		group, err := user.LookupGroup(groupName)
+		if _, ok := err.(user.UnknownGroupError); ok {
+			group, err = user.LookupGroupId(groupName)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("cannot find group: %s, %s", groupName, err)
+		}
+		gid = group.Gid
+	}
+	parsedGid, err := strconv.ParseUint(gid, 10, 32)
+	if err != nil {
+		return nil, err
+	}
+	credential.Gid = uint32(parsedGid)
+
+	if groupIds, err := target.GroupIds(); err == nil {
+		for _, groupId := range groupIds {
+			if id, err := strconv.ParseUint(groupId, 10, 32); err == nil {
+				credential.Groups = append(credential.Groups, uint32(id))
+			}
+		}
+	}
+
+	return &credential, nil
+}
+
+// CheckCredential verifies the collectors can run with the credential from the given
+// working directory. Switching to another identity requires root, while running as the
+// current non-root identity skips setgroups, which would fail without privileges.
+func CheckCredential(credential *syscall.Credential, dir string) error {
+	if credential == nil {
+		return nil
+	}
+	if euid := Geteuid(); euid != 0 {
+		if int(credential.Uid) != euid || int(credential.Gid) != Getegid() {
+			return fmt.Errorf("cannot run as uid: %d gid: %d, switching credentials requires root (running as uid: %d)",
+				credential.Uid, credential.Gid, euid)
+		}
+		credential.NoSetGroups = true
+	}
+	return CheckSearchable(credential, dir)
+}
+
+// CheckSearchable verifies every directory leading to dir can be traversed with the
+// credential, otherwise the collectors fail to start on their working directory.
+func CheckSearchable(credential *syscall.Credential, dir string) error {
+	if credential.Uid == 0 {
+		return nil
+	}
+	groups := map[uint32]bool{credential.Gid: true}
+	for _, group := range credential.Groups {
+		groups[group] = true
+	}
+
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+	for current := dir; ; current = filepath.Dir(current) {
+		var stat syscall.Stat_t
+		if err := syscall.Stat(current, &stat); err != nil {
+			return fmt.Errorf("cannot stat directory: %s, %s", current, err)
+		}
+		searchable := stat.Mode&01 != 0
+		if stat.Uid == credential.Uid {
+			searchable = stat.Mode&0100 != 0
+		} else if groups[stat.Gid] {
+			searchable = stat.Mode&010 != 0
+		}
+		if !searchable {
+			return fmt.Errorf("directory: %s cannot be traversed by uid: %d, use a base directory reachable by it", current, credential.Uid)
+		}
+		if current == filepath.Dir(current) {
+			return nil
+		}
+	}
+}
+
+// SysProcAttr returns the attributes of every command run for the task, each one
+// on its own process group and with the task credential, if any.
+func (task *SchedulerTask) SysProcAttr() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{Setpgid: true, Credential: task.Credential}
+}
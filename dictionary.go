@@ -0,0 +1,154 @@
+package main
+
+import (
+	"sort"
+	"strings"
+)
+
+const (
+	CollectionsInfoTableName = "_repeat_collections"
+	ColumnsInfoTableName     = "_repeat_columns"
+)
+
+// CollectionInfo describes a collection of a session, so the stored results can be
+// labelled without the configuration file.
+type CollectionInfo struct {
+	ID          uint `gorm:"primary_key"`
+	SessionID   uint `gorm:"index"`
+	Name        string
+	Description string
+	Unit        string
+	Command     string
+	Store       string
+	Mode        string
+	RunEvery    string
+	Tables      string
+}
+
+func (CollectionInfo) TableName() string {
+	return CollectionsInfoTableName
+}
+
+// ColumnInfo describes a column of a collection table, with its type and unit.
+type ColumnInfo struct {
+	ID          uint `gorm:"primary_key"`
+	SessionID   uint `gorm:"index"`
+	Collection  string
+	Table       string
+	Column      string
+	Type        string
+	Unit        string
+	Description string
+}
+
+func (ColumnInfo) TableName() string {
+	return ColumnsInfoTableName
+}
+
+// builtinColumnsInfo describes the columns every collection table has besides its fields.
+var builtinColumnsInfo = []ColumnInfo{
+	{Column: "created_at", Type: "timestamp", Description: "collection time of the row, in UTC"},
+	{Column: "session_id", Type: "int", Description: "session that stored the row, see the sessions table"},
+	{Column: "run_id", Type: "string", Description: "collector run that produced the row, see the run_history table"},
+}
+
+// Describe returns the description of the collection and of the columns of its tables,
+// columns are only described for collections stored on the database. Tables are named
+// as configured, CreateTable records the versioned table they are stored on.
+func (task *SchedulerTask) Describe() (CollectionInfo, []ColumnInfo) {
+	command := task.Command
+	if task.Config.Script != "" {
+		command = task.Config.Script
+	}
+	collection := CollectionInfo{Name: task.Name, Description: task.Config.Description, Unit: task.Config.Unit,
+		Command: command, Store: task.Config.Store, Mode: task.Config.Mode, RunEvery: task.RunEvery.String()}
+	if task.Config.Store != "database" {
+		return collection, nil
+	}
+
+	collection.Tables = task.TableNames()
+	var columns []ColumnInfo
+	for _, table := range task.DBTables() {
+		for _, column := range builtinColumnsInfo {
+			column.Collection, column.Table = task.Name, table.Name
+			columns = append(columns, column)
+		}
+		for _, field := range table.MapValues.Fields {
+			fieldType := field.Type
+			if field.Timestamp {
+				fieldType = "timestamp"
+			} else if fieldType != "int" && fieldType != "float" {
+				fieldType = "string"
+			}
+			columns = append(columns, ColumnInfo{Collection: task.Name, Table: table.Name, Column: field.Name,
+				Type: fieldType, Unit: field.Unit, Description: field.Description})
+		}
+	}
+	return collection, columns
+}
+
+// WriteDataDictionary stores the description of the collections and their columns for
+// the current session.
+func (db *DBStorage) WriteDataDictionary(collections []CollectionInfo, columns []ColumnInfo) error {
+	tx := db.Begin()
+	for _, collection := range collections {
+		collection.SessionID = db.SessionID
+		if err := tx.Create(&collection).Error; err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	for _, column := range columns {
+		column.SessionID = db.SessionID
+		if err := tx.Create(&column).Error; err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit().Error
+}
+
+// ResolveDictionaryTable replaces the configured name of a table by the versioned table
+// its rows are stored on in the data dictionary of the current session.
+func (db *DBStorage) ResolveDictionaryTable(tableName, table string) error {
+	if err := db.Model(&ColumnInfo{}).Where("session_id = ? AND \"table\" = ?", db.SessionID, tableName).
+		Update("table", table).Error; err != nil {
+		return err
+	}
+	var collections []CollectionInfo
+	if err := db.Where("session_id = ?", db.SessionID).Find(&collections).Error; err != nil {
+		return err
+	}
+	for _, collection := range collections {
+		names := strings.Split(collection.Tables, ", ")
+		for i, name := range names {
+			if name == tableName {
+				names[i] = table
+			}
+		}
+		if tables := strings.Join(names, ", "); tables != collection.Tables {
+			if err := db.Model(&collection).Update("tables", tables).Error; err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// DescribeCollections writes the data dictionary of the loaded collections into the database.
+func (scheduler *Scheduler) DescribeCollections() error {
+	var names []string
+	for name := range scheduler.Tasks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var collections []CollectionInfo
+	var columns []ColumnInfo
+	for _, name := range names {
+		collection, taskColumns := scheduler.Tasks[name].Describe()
+		collections = append(collections, collection)
+		columns = append(columns, taskColumns...)
+	}
+	return scheduler.DBStorage.WriteDataDictionary(collections, columns)
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+var exitCodeRangeRegex = regexp.MustCompile(`^(\d+)-(\d+)$`)
+
+var signalNames = map[string]syscall.Signal{
+	"SIGHUP":  syscall.SIGHUP,
+	"SIGINT":  syscall.SIGINT,
+	"SIGQUIT": syscall.SIGQUIT,
+	"SIGILL":  syscall.SIGILL,
+	"SIGTRAP": syscall.SIGTRAP,
+	"SIGABRT": syscall.SIGABRT,
+	"SIGBUS":  syscall.SIGBUS,
+	"SIGFPE":  syscall.SIGFPE,
+	"SIGKILL": syscall.SIGKILL,
+	"SIGUSR1": syscall.SIGUSR1,
+	"SIGSEGV": syscall.SIGSEGV,
+	"SIGUSR2": syscall.SIGUSR2,
+	"SIGPIPE": syscall.SIGPIPE,
+	"SIGALRM": syscall.SIGALRM,
+	"SIGTERM": syscall.SIGTERM,
+}
+
+type exitCodeRule struct {
+	negate    bool
+	low, high int
+	signal    syscall.Signal
+}
+
+func (rule *exitCodeRule) matches(code int, signal syscall.Signal) bool {
+	if rule.signal != 0 {
+		// shells report a child killed by a signal as 128 + signal number.
+		return signal == rule.signal || code == 128+int(rule.signal)
+	}
+	return code >= rule.low && code <= rule.high
+}
+
+// ExitCodes is a parsed exit-codes expression: a space separated list of codes (0),
+// ranges (0-3), signal names (SIGPIPE) or the any keyword. Terms prefixed with !
+// are excluded, an expression made only of exclusions allows anything else.
+type ExitCodes struct {
+	any   bool
+	rules []exitCodeRule
+}
+
+func ParseExitCodes(expression string) (*ExitCodes, error) {
+	var exitCodes ExitCodes
+	var allowed int
+
+	terms := strings.Fields(expression)
+	if len(terms) == 0 {
+		return nil, fmt.Errorf("empty exit-codes expression")
+	}
+
+	for _, term := range terms {
+		var rule exitCodeRule
+		if strings.HasPrefix(term, "!") {
+			rule.negate = true
+			term = term[1:]
+		}
+
+		if term == DEFAULT_ANY_EXIT_CODE {
+			if rule.negate {
+				return nil, fmt.Errorf("invalid exit-codes term: !%s", term)
+			}
+			exitCodes.any = true
+			continue
+		}
+
+		if code, err := strconv.Atoi(term); err == nil {
+			rule.low, rule.high = code, code
+		} else if matches := exitCodeRangeRegex.FindStringSubmatch(term); matches != nil {
+			rule.low, _ = strconv.Atoi(matches[1])
+			rule.high, _ = strconv.Atoi(matches[2])
+			if rule.low > rule.high {
+				return nil, fmt.Errorf("invalid exit-codes range: %s", term)
+			}
+		} else if signal, ok := signalNames[strings.ToUpper(term)]; ok {
+			rule.signal = signal
+		} else {
+			return nil, fmt.Errorf("invalid exit-codes term: %s, expected a code, a range (0-3), a signal name "+
+				"(SIGPIPE) or %s", term, DEFAULT_ANY_EXIT_CODE)
+		}
+
+		if !rule.negate {
+			allowed++
+		}
+		exitCodes.rules = append(exitCodes.rules, rule)
+	}
+
+	if allowed == 0 {
+		exitCodes.any = true
+	}
+	return &exitCodes, nil
+}
+
+// Matches reports if a command that exited with code, or was killed by signal, is allowed.
+func (exitCodes *ExitCodes) Matches(code int, signal syscall.Signal) bool {
+	allowed := exitCodes.any
+	for _, rule := range exitCodes.rules {
+		if !rule.matches(code, signal) {
+			continue
+		}
+		if rule.negate {
+			return false
+		}
+		allowed = true
+	}
+	return allowed
+}
+
+// MatchesError is like Matches, extracting the exit status from the error returned by a command.
+func (exitCodes *ExitCodes) MatchesError(err error) bool {
+	exitError, ok := err.(*exec.ExitError)
+	if !ok {
+		// the command did not run at all, only a plain any allows it.
+		return exitCodes.any && len(exitCodes.rules) == 0
+	}
+	var signal syscall.Signal
+	if status, ok := exitError.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		signal = status.Signal()
+	}
+	return exitCodes.Matches(exitError.ExitCode(), signal)
+}
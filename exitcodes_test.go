@@ -0,0 +1,44 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"os/exec"
+	"syscall"
+	"testing"
+)
+
+func TestParseExitCodesExpressions(t *testing.T) {
+	exitCodes, err := ParseExitCodes("0-3 !2 127")
+	assert.Nil(t, err)
+	assert.True(t, exitCodes.Matches(0, 0))
+	assert.True(t, exitCodes.Matches(3, 0))
+	assert.True(t, exitCodes.Matches(127, 0))
+	assert.False(t, exitCodes.Matches(2, 0))
+	assert.False(t, exitCodes.Matches(4, 0))
+
+	exitCodes, err = ParseExitCodes("!1")
+	assert.Nil(t, err)
+	assert.True(t, exitCodes.Matches(0, 0))
+	assert.True(t, exitCodes.Matches(126, 0))
+	assert.False(t, exitCodes.Matches(1, 0))
+
+	exitCodes, err = ParseExitCodes("0 sigpipe")
+	assert.Nil(t, err)
+	assert.True(t, exitCodes.Matches(-1, syscall.SIGPIPE))
+	assert.True(t, exitCodes.Matches(141, 0))
+	assert.False(t, exitCodes.Matches(-1, syscall.SIGKILL))
+
+	for _, invalid := range []string{"", "zero", "3-1", "!any", "0,1"} {
+		_, err = ParseExitCodes(invalid)
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestExitCodesMatchesKilledCommand(t *testing.T) {
+	exitCodes, _ := ParseExitCodes("0 SIGTERM")
+	err := exec.Command("bash", "-c", "kill -TERM $$").Run()
+	assert.True(t, exitCodes.MatchesError(err))
+
+	exitCodes, _ = ParseExitCodes("0")
+	assert.False(t, exitCodes.MatchesError(err))
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// lifecycle coordinates the shutdown of a session: the root context is cancelled by the
+// scheduler timeout, a termination signal or an error, and the wait group tracks every
+// collector run so nothing is left writing once the insert queue gets closed.
+type lifecycle struct {
+	ctx        context.Context
+	cancel     context.CancelFunc
+	runs       sync.WaitGroup
+	lock       sync.Mutex
+	stopped    bool
+	stopReason string
+	inserted   chan struct{}
+}
+
+func newLifecycle() *lifecycle {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &lifecycle{ctx: ctx, cancel: cancel}
+}
+
+// Done is closed once the scheduler is stopping, it never closes for a scheduler
+// that was not created by NewScheduler.
+func (scheduler *Scheduler) Done() <-chan struct{} {
+	if scheduler.lifecycle == nil {
+		return nil
+	}
+	return scheduler.lifecycle.ctx.Done()
+}
+
+// Context returns the root context of the session, cancelled once the scheduler is stopping.
+func (scheduler *Scheduler) Context() context.Context {
+	if scheduler == nil || scheduler.lifecycle == nil {
+		return context.Background()
+	}
+	return scheduler.lifecycle.ctx
+}
+
+func (scheduler *Scheduler) IsStopping() bool {
+	select {
+	case <-scheduler.Done():
+		return true
+	default:
+		return false
+	}
+}
+
+// Stop cancels the session, running collectors are terminated by Cleanup.
+func (scheduler *Scheduler) Stop(reason string) {
+	if scheduler.lifecycle == nil {
+		return
+	}
+	scheduler.lifecycle.lock.Lock()
+	if scheduler.lifecycle.stopReason == "" {
+		scheduler.lifecycle.stopReason = reason
+		log.Infof("Stopping scheduler, reason: %s", reason)
+	}
+	scheduler.lifecycle.lock.Unlock()
+	scheduler.lifecycle.cancel()
+}
+
+// BeginRun registers a collector run, it returns false once the scheduler is stopping.
+// Every successful call must be paired with EndRun.
+func (scheduler *Scheduler) BeginRun() bool {
+	if scheduler.lifecycle == nil {
+		return true
+	}
+	scheduler.lifecycle.lock.Lock()
+	defer scheduler.lifecycle.lock.Unlock()
+	if scheduler.lifecycle.stopped || scheduler.IsStopping() {
+		return false
+	}
+	scheduler.lifecycle.runs.Add(1)
+	return true
+}
+
+func (scheduler *Scheduler) EndRun() {
+	if scheduler.lifecycle != nil {
+		scheduler.lifecycle.runs.Done()
+	}
+}
+
+// Sleep waits for the given duration, it returns false if the scheduler stopped meanwhile.
+func (scheduler *Scheduler) Sleep(duration time.Duration) bool {
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-scheduler.Done():
+		return false
+	}
+}
+
+// WaitForRuns blocks new runs and waits for the running ones to finish, the
+// process groups of the runs are terminated again while any is left.
+func (scheduler *Scheduler) WaitForRuns() {
+	scheduler.lifecycle.lock.Lock()
+	scheduler.lifecycle.stopped = true
+	scheduler.lifecycle.lock.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		scheduler.lifecycle.runs.Wait()
+		close(done)
+	}()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-time.After(DefaultShutdownGracePeriod):
+			log.Warnf("Collector runs still in progress, terminating their process groups")
+			scheduler.ProcessGroups.Terminate(DefaultShutdownGracePeriod)
+		}
+	}
+}
+
+// WaitForStop blocks until the session is cancelled, the timeout expires or a
+// termination signal is received.
+func (scheduler *Scheduler) WaitForStop() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	var timeout <-chan time.Time
+	if scheduler.Timeout != nil && *scheduler.Timeout > 0 {
+		timer := time.NewTimer(*scheduler.Timeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case <-timeout:
+		scheduler.Stop(fmt.Sprintf("scheduler timeout (%f secs) reached", scheduler.Timeout.Seconds()))
+	case received := <-signals:
+		scheduler.Stop(fmt.Sprintf("received signal: %s", received))
+	case <-scheduler.Done():
+	}
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+)
+
+const CgroupRoot = "/sys/fs/cgroup"
+
+const (
+	ioprioWhoPgrp    = 2
+	ioprioClassShift = 13
+)
+
+var ioniceClasses = map[string]int{
+	"realtime":    1,
+	"best-effort": 2,
+	"idle":        3,
+}
+
+var rlimitResources = []struct {
+	name     string
+	resource int
+}{
+	{"cpu", syscall.RLIMIT_CPU},
+	{"address-space", syscall.RLIMIT_AS},
+	{"open-files", syscall.RLIMIT_NOFILE},
+}
+
+// ProcessLimits are the resource limits applied to every run of a collector.
+type ProcessLimits struct {
+	Nice            int
+	IOClass         int
+	IOLevel         int
+	IONice          string
+	Rlimits         map[string]uint64
+	CgroupMemoryMax int64
+	CgroupCPUMax    string
+}
+
+func ParseIONice(ionice string) (int, int, error) {
+	parts := strings.SplitN(ionice, ":", 2)
+	class, ok := ioniceClasses[parts[0]]
+	if !ok {
+		return 0, 0, fmt.Errorf("invalid ionice class: %s, must be one of: realtime, best-effort, idle", parts[0])
+	}
+	level := 4
+	if len(parts) == 2 {
+		parsed, err := strconv.Atoi(parts[1])
+		if err != nil || parsed < 0 || parsed > 7 {
+			return 0, 0, fmt.Errorf("invalid ionice level: %s, must be between 0 and 7", parts[1])
+		}
+		level = parsed
+	}
+	return class, level, nil
+}
+
+// ParseCPUMax converts a cpu percentage (e.g: 50%) into a cgroup v2 cpu.max value.
+func ParseCPUMax(cpuMax string) (string, error) {
+	const period = 100000
+	percentage, err := strconv.ParseFloat(strings.TrimSuffix(strings.TrimSpace(cpuMax), "%"), 64)
+	if err != nil || percentage <= 0 {
+		return "", fmt.Errorf("invalid cgroup cpu-max: %s, expected a percentage (e.g: 50%%)", cpuMax)
+	}
+	return fmt.Sprintf("%d %d", int64(percentage*period/100), period), nil
+}
+
+func NewProcessLimits(collection Collection) (*ProcessLimits, error) {
+	var err error
+	limits := ProcessLimits{Nice: collection.Nice, IONice: collection.IONice, Rlimits: make(map[string]uint64)}
+
+	if limits.Nice < -20 || limits.Nice > 19 {
+		return nil, fmt.Errorf("invalid nice value: %d, must be between -20 and 19", limits.Nice)
+	}
+
+	if collection.IONice != "" {
+		if limits.IOClass, limits.IOLevel, err = ParseIONice(collection.IONice); err != nil {
+			return nil, err
+		}
+	}
+
+	if collection.Rlimits.CPU > 0 {
+		limits.Rlimits["cpu"] = uint64(collection.Rlimits.CPU)
+	}
+	if collection.Rlimits.AddressSpace != "" {
+		size, err := ParseSize(collection.Rlimits.AddressSpace)
+		if err != nil {
+			return nil, err
+		}
+		limits.Rlimits["address-space"] = uint64(size)
+	}
+	if collection.Rlimits.OpenFiles > 0 {
+		limits.Rlimits["open-files"] = uint64(collection.Rlimits.OpenFiles)
+	}
+
+	if collection.Cgroup.MemoryMax != "" {
+		if limits.CgroupMemoryMax, err = ParseSize(collection.Cgroup.MemoryMax); err != nil {
+			return nil, err
+		}
+	}
+	if collection.Cgroup.CPUMax != "" {
+		if limits.CgroupCPUMax, err = ParseCPUMax(collection.Cgroup.CPUMax); err != nil {
+			return nil, err
+		}
+	}
+
+	return &limits, nil
+}
+
+func (limits *ProcessLimits) HasCgroup() bool {
+	return limits.CgroupMemoryMax > 0 || limits.CgroupCPUMax != ""
+}
+
+func (limits *ProcessLimits) IsEmpty() bool {
+	return limits.Nice == 0 && limits.IOClass == 0 && len(limits.Rlimits) == 0 && !limits.HasCgroup()
+}
+
+func prlimit(pid, resource int, limit *syscall.Rlimit) error {
+	_, _, errno := syscall.RawSyscall6(syscall.SYS_PRLIMIT64, uintptr(pid), uintptr(resource),
+		uintptr(unsafe.Pointer(limit)), 0, 0, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func ioprioSet(which, who, ioprio int) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOPRIO_SET, uintptr(which), uintptr(who), uintptr(ioprio))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// Apply sets the limits on the process group started by pid. It returns the limits that
+// were applied, the ones that could not be applied, and a function that releases the
+// transient cgroup once the run has finished.
+func (limits *ProcessLimits) Apply(name string, pid int) (applied []string, failed []string, release func()) {
+	release = func() {}
+
+	if limits.Nice != 0 {
+		if err := syscall.Setpriority(syscall.PRIO_PGRP, pid, limits.Nice); err != nil {
+			failed = append(failed, fmt.Sprintf("nice=%d (%s)", limits.Nice, err))
+		} else {
+			applied = append(applied, fmt.Sprintf("nice=%d", limits.Nice))
+		}
+	}
+
+	if limits.IOClass != 0 {
+		if err := ioprioSet(ioprioWhoPgrp, pid, limits.IOClass<<ioprioClassShift|limits.IOLevel); err != nil {
+			failed = append(failed, fmt.Sprintf("ionice=%s (%s)", limits.IONice, err))
+		} else {
+			applied = append(applied, fmt.Sprintf("ionice=%s", limits.IONice))
+		}
+	}
+
+	for _, rlimit := range rlimitResources {
+		value, ok := limits.Rlimits[rlimit.name]
+		if !ok {
+			continue
+		}
+		if err := prlimit(pid, rlimit.resource, &syscall.Rlimit{Cur: value, Max: value}); err != nil {
+			failed = append(failed, fmt.Sprintf("rlimit-%s=%d (%s)", rlimit.name, value, err))
+		} else {
+			applied = append(applied, fmt.Sprintf("rlimit-%s=%d", rlimit.name, value))
+		}
+	}
+
+	if limits.HasCgroup() {
+		cgroupDir, cgroupApplied, err := limits.applyCgroup(name, pid)
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("cgroup (%s)", err))
+		} else {
+			applied = append(applied, cgroupApplied...)
+			release = func() {
+				// the cgroup can only be removed once every process on it exited.
+				_ = os.Remove(cgroupDir)
+			}
+		}
+	}
+
+	return applied, failed, release
+}
+
+// OwnCgroupDir returns the cgroup v2 directory of the running process.
+func OwnCgroupDir() (string, error) {
+	if _, err := os.Stat(filepath.Join(CgroupRoot, "cgroup.controllers")); err != nil {
+		return "", fmt.Errorf("cgroup v2 is not available")
+	}
+	fd, err := os.Open("/proc/self/cgroup")
+	if err != nil {
+		return "", err
+	}
+	defer fd.Close()
+
+	scanner := bufio.NewScanner(fd)
+	for scanner.Scan() {
+		if strings.HasPrefix(scanner.Text(), "0::") {
+			return filepath.Join(CgroupRoot, strings.TrimPrefix(scanner.Text(), "0::")), nil
+		}
+	}
+	return "", fmt.Errorf("cannot find the cgroup v2 of the process")
+}
+
+func (limits *ProcessLimits) applyCgroup(name string, pid int) (string, []string, error) {
+	var applied []string
+
+	parent, err := OwnCgroupDir()
+	if err != nil {
+		return "", nil, err
+	}
+
+	controllers := map[string]bool{"memory": limits.CgroupMemoryMax > 0, "cpu": limits.CgroupCPUMax != ""}
+	for controller, needed := range controllers {
+		if needed {
+			// fails if the controller is already enabled or cannot be delegated, the
+			// write of the limit below tells which one is the case.
+			_ = ioutil.WriteFile(filepath.Join(parent, "cgroup.subtree_control"), []byte("+"+controller), 0644)
+		}
+	}
+
+	cgroupDir := filepath.Join(parent, fmt.Sprintf("repeat-%s-%d", name, pid))
+	if err := os.Mkdir(cgroupDir, 0755); err != nil {
+		return "", nil, err
+	}
+
+	var writeErr error
+	if limits.CgroupMemoryMax > 0 {
+		value := strconv.FormatInt(limits.CgroupMemoryMax, 10)
+		if writeErr = ioutil.WriteFile(filepath.Join(cgroupDir, "memory.max"), []byte(value), 0644); writeErr == nil {
+			applied = append(applied, "cgroup-memory.max="+value)
+		}
+	}
+	if writeErr == nil && limits.CgroupCPUMax != "" {
+		if writeErr = ioutil.WriteFile(filepath.Join(cgroupDir, "cpu.max"), []byte(limits.CgroupCPUMax), 0644); writeErr == nil {
+			applied = append(applied, "cgroup-cpu.max="+limits.CgroupCPUMax)
+		}
+	}
+	if writeErr == nil {
+		writeErr = ioutil.WriteFile(filepath.Join(cgroupDir, "cgroup.procs"), []byte(strconv.Itoa(pid)), 0644)
+	}
+	if writeErr != nil {
+		_ = os.Remove(cgroupDir)
+		return "", nil, writeErr
+	}
+	return cgroupDir, applied, nil
+}
+
+// limitsGateScript holds the started collector on a read of fd 3, and executes the
+// collector command once the write end of the pipe is closed.
+const limitsGateScript = `read -r gate <&3; exec 3<&-; exec "$@"`
+
+// LimitsGate holds a started collector before its command executes, so the limits applied
+// meanwhile are inherited by the command and every process it forks.
+type LimitsGate struct {
+	hold, release *os.File
+}
+
+// LimitedCommandArgs returns the argv executed for the task and the gate holding it until
+// ApplyLimits released it, the gate is nil if the task has no limits.
+func (task *SchedulerTask) LimitedCommandArgs() ([]string, *LimitsGate, error) {
+	argv := task.CommandArgs()
+	if task.Limits == nil || task.Limits.IsEmpty() {
+		return argv, nil, nil
+	}
+	command := argv[0]
+	if !strings.Contains(command, "/") {
+		// fail like a direct start would, instead of on the gate once started.
+		path, err := exec.LookPath(command)
+		if err != nil {
+			return nil, nil, err
+		}
+		command = path
+	}
+	hold, release, err := os.Pipe()
+	if err != nil {
+		return nil, nil, err
+	}
+	gated := append([]string{"/bin/sh", "-c", limitsGateScript, "repeat-limits", command}, argv[1:]...)
+	return gated, &LimitsGate{hold: hold, release: release}, nil
+}
+
+// Attach passes the gate to the command as fd 3, it must be called before Start.
+func (gate *LimitsGate) Attach(cmd *exec.Cmd) {
+	if gate != nil {
+		cmd.ExtraFiles = []*os.File{gate.hold}
+	}
+}
+
+// Open lets the held command execute, opening an already open gate does nothing.
+func (gate *LimitsGate) Open() {
+	if gate != nil {
+		_ = gate.hold.Close()
+		_ = gate.release.Close()
+	}
+}
+
+// ApplyLimits sets the collection limits on a started run held by the gate, and opens it.
+// The applied limits are reported on the first run and kept for the session summary.
+func (task *SchedulerTask) ApplyLimits(gate *LimitsGate, pid int) func() {
+	defer gate.Open()
+
+	if task.Limits == nil || task.Limits.IsEmpty() {
+		return func() {}
+	}
+	applied, failed, release := task.Limits.Apply(task.Name, pid)
+	report := strings.Join(applied, " ")
+	if report == "" {
+		report = "none"
+	}
+
+	if atomic.CompareAndSwapInt32(&task.LimitsReported, 0, 1) {
+		log.Infof("Collector %s, applied limits: %s", task.Name, report)
+		if len(failed) > 0 {
+			log.Warnf("Collector %s, limits not applied: %s", task.Name, strings.Join(failed, ", "))
+		}
+	} else if len(failed) > 0 {
+		log.Debugf("Collector %s, limits not applied: %s", task.Name, strings.Join(failed, ", "))
+	}
+
+	task.Stats.Lock()
+	task.Stats.Limits = report
+	task.Stats.Unlock()
+	return release
+}
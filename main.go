@@ -8,12 +8,14 @@ import (
 
 func main() {
 	var (
-		logLevel   = kingpin.Flag("loglevel", "Log level: [debug, info, warn, error, fatal]").Short('l').Default("info").String()
-		timeout    = kingpin.Flag("timeout", "Timeout: overall timeout for all collectors").Short('t').Default("0s").Duration()
-		config     = kingpin.Flag("config", "Path to collectors configuration file").Short('c').Required().String()
-		baseDir    = kingpin.Flag("basedir", "Temporary base directory to create the resulting collection tarball").Short('b').Default("/tmp").String()
-		resultsDir = kingpin.Flag("results-dir", "Directory to store the resulting collection tarball").Short('r').Default(".").String()
-		dbDir      = kingpin.Flag("db-dir", "Path to store the local results database").Default(".").String()
+		logLevel      = kingpin.Flag("loglevel", "Log level: [debug, info, warn, error, fatal]").Short('l').Default("info").String()
+		timeout       = kingpin.Flag("timeout", "Timeout: overall timeout for all collectors").Short('t').Default("0s").Duration()
+		config        = kingpin.Flag("config", "Path to collectors configuration file").Short('c').Required().String()
+		baseDir       = kingpin.Flag("basedir", "Temporary base directory to create the resulting collection tarball").Short('b').Default("/tmp").String()
+		resultsDir    = kingpin.Flag("results-dir", "Directory to store the resulting collection tarball").Short('r').Default(".").String()
+		dbDir         = kingpin.Flag("db-dir", "Directory to keep a persistent results database, appended across sessions (default: only in the report)").Default("").String()
+		maxConcurrent = kingpin.Flag("max-concurrent", "Maximum number of collector runs executing at the same time (0 means unlimited)").Default("0").Int()
+		runAs         = kingpin.Flag("run-as", "User to run collectors as, unless the collection sets its own user").Default("").String()
 	)
 
 	kingpin.HelpFlag.Short('h')
@@ -33,11 +35,14 @@ func main() {
 	log.SetLevel(parsedLogLevel)
 	log.SetOutput(os.Stdout)
 
-	scheduler, err := NewScheduler(*config, timeout, *baseDir, *resultsDir, *dbDir)
+	scheduler, err := NewScheduler(*config, timeout, *baseDir, *resultsDir, *dbDir, *maxConcurrent, *runAs)
 	if err != nil {
 		log.Errorf("Cannot enable scheduler, exiting, error: %s", err.Error())
 		os.Exit(-1)
 	}
 
-	log.Fatal(scheduler.Start())
+	if err := scheduler.Start(); err != nil {
+		log.Errorf("Scheduler stopped with error: %s", err)
+		os.Exit(-1)
+	}
 }
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+const (
+	// MaxOutputTruncate keeps the first max-output bytes and discards the rest.
+	MaxOutputTruncate = "truncate"
+	// MaxOutputAbort kills the command once it exceeds max-output bytes.
+	MaxOutputAbort = "abort"
+)
+
+// TimedOutSuffix flags result files holding the partial output of a timed out run.
+const TimedOutSuffix = ".timedout"
+
+// TruncatedSuffix flags result files whose output was cut at max-output bytes.
+const TruncatedSuffix = ".truncated"
+
+// StderrSuffix is appended to result files to store the stderr of the run.
+const StderrSuffix = ".stderr"
+
+// RunResult holds the output of a single command run. Output is empty if the
+// results were written straight into OutputFile, and Stderr is empty if the
+// collection merges it into the output.
+type RunResult struct {
+	RunID      string
+	StartedAt  time.Time
+	Output     []byte
+	OutputFile string
+	Stderr     []byte
+	TimedOut   bool
+	Truncated  bool
+	Aborted    bool
+}
+
+// LimitedWriter forwards writes to W until Limit bytes are written, anything after
+// that is discarded and OnExceed is called once. A zero Limit means unlimited.
+type LimitedWriter struct {
+	W        io.Writer
+	Limit    int64
+	Written  int64
+	Exceeded bool
+	OnExceed func()
+}
+
+func (lw *LimitedWriter) Write(p []byte) (int, error) {
+	if lw.Limit <= 0 || lw.Written+int64(len(p)) <= lw.Limit {
+		n, err := lw.W.Write(p)
+		lw.Written += int64(n)
+		return n, err
+	}
+	if remaining := lw.Limit - lw.Written; remaining > 0 {
+		n, err := lw.W.Write(p[:remaining])
+		lw.Written += int64(n)
+		if err != nil {
+			return n, err
+		}
+	}
+	if !lw.Exceeded {
+		lw.Exceeded = true
+		if lw.OnExceed != nil {
+			lw.OnExceed()
+		}
+	}
+	// report the whole buffer as written, so the command keeps running on truncate.
+	return len(p), nil
+}
+
+// OutputCapture wires the command stdout and stderr, honouring max-output. For file
+// stores stdout is written directly into the result file instead of memory.
+type OutputCapture struct {
+	stdout, stderr bytes.Buffer
+	stdoutLimit    *LimitedWriter
+	stderrLimit    *LimitedWriter
+	file           *os.File
+	aborted        bool
+}
+
+func NewOutputCapture(task *SchedulerTask, cmd *exec.Cmd) (*OutputCapture, error) {
+	var capture OutputCapture
+	var stdout io.Writer = &capture.stdout
+
+	if task.Config.Store == "file" {
+		file, err := os.OpenFile(task.ResultFileName(), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0750)
+		if err != nil {
+			return nil, err
+		}
+		capture.file = file
+		stdout = file
+	}
+
+	onExceed := func() {
+		log.Warnf("Collector %s output exceeded max-output of %d bytes (on-max-output: %s)",
+			task.Name, task.MaxOutput, task.Config.OnMaxOutput)
+		if task.Config.OnMaxOutput == MaxOutputAbort && cmd.Process != nil {
+			capture.aborted = true
+			KillProcessGroup(cmd.Process.Pid, syscall.SIGKILL)
+		}
+	}
+
+	capture.stdoutLimit = &LimitedWriter{W: stdout, Limit: task.MaxOutput, OnExceed: onExceed}
+	cmd.Stdout = capture.stdoutLimit
+	if task.Config.MergeStderr {
+		cmd.Stderr = capture.stdoutLimit
+	} else {
+		capture.stderrLimit = &LimitedWriter{W: &capture.stderr, Limit: task.MaxOutput, OnExceed: onExceed}
+		cmd.Stderr = capture.stderrLimit
+	}
+	return &capture, nil
+}
+
+// Result must be called once the command has exited.
+func (capture *OutputCapture) Result() *RunResult {
+	result := &RunResult{
+		Stderr:    capture.stderr.Bytes(),
+		Truncated: capture.stdoutLimit.Exceeded || (capture.stderrLimit != nil && capture.stderrLimit.Exceeded),
+		Aborted:   capture.aborted,
+	}
+	if capture.file != nil {
+		result.OutputFile = capture.file.Name()
+	} else {
+		result.Output = capture.stdout.Bytes()
+	}
+	return result
+}
+
+func (capture *OutputCapture) Close() error {
+	if capture.file == nil {
+		return nil
+	}
+	return capture.file.Close()
+}
+
+// Discard closes and removes the result file of a run whose command could not be started,
+// so failed runs do not leave empty files in the report.
+func (capture *OutputCapture) Discard() {
+	if capture.file == nil {
+		return
+	}
+	capture.file.Close()
+	if err := os.Remove(capture.file.Name()); err != nil {
+		log.Errorf("Cannot remove result file %s: %s", capture.file.Name(), err)
+	}
+	capture.file = nil
+}
+
+func (task *SchedulerTask) ResultFileName() string {
+	return filepath.Join(task.BaseDir, fmt.Sprintf("%s-%s", task.Name, time.Now().Format("2006-01-02-15:04:05")))
+}
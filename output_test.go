@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"testing"
+	"time"
+)
+
+func TestLimitedWriterTruncates(t *testing.T) {
+	var buffer bytes.Buffer
+	exceeded := 0
+	writer := &LimitedWriter{W: &buffer, Limit: 5, OnExceed: func() { exceeded++ }}
+
+	n, err := writer.Write([]byte("abc"))
+	assert.Nil(t, err)
+	assert.Equal(t, 3, n)
+	n, err = writer.Write([]byte("defgh"))
+	assert.Nil(t, err)
+	assert.Equal(t, 5, n)
+	_, _ = writer.Write([]byte("ijk"))
+
+	assert.Equal(t, "abcde", buffer.String())
+	assert.True(t, writer.Exceeded)
+	assert.Equal(t, 1, exceeded)
+}
+
+func TestRunWritesFileStoresToDisk(t *testing.T) {
+	dir, err := ioutil.TempDir("", DEFAULT_REPORT_PREFIX)
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	task := &SchedulerTask{Name: "disk", Command: "echo direct", BaseDir: dir}
+	task.Config.Store = "file"
+
+	result, err := RunWithoutTimeout(task)
+	require.Nil(t, err)
+	assert.Empty(t, result.Output)
+	assert.FileExists(t, result.OutputFile)
+	content, _ := ioutil.ReadFile(result.OutputFile)
+	assert.Equal(t, "direct\n", string(content))
+}
+
+func TestRunAbortsOnMaxOutput(t *testing.T) {
+	dir, err := ioutil.TempDir("", DEFAULT_REPORT_PREFIX)
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	task := &SchedulerTask{Name: "runaway", Command: "yes", BaseDir: dir, MaxOutput: 1024}
+	task.Config.Store = "database"
+	task.Config.OnMaxOutput = MaxOutputAbort
+
+	result, err := task.Execute()
+	assert.Error(t, err)
+	require.NotNil(t, result)
+	assert.True(t, result.Aborted)
+	assert.Len(t, result.Output, 1024)
+}
+
+func TestRunRemovesResultFileWhenStartFails(t *testing.T) {
+	defer func(execCommandContext func(context.Context, string, ...string) *exec.Cmd) {
+		ExecCommandContext = execCommandContext
+	}(ExecCommandContext)
+	ExecCommandContext = exec.CommandContext
+
+	dir, err := ioutil.TempDir("", DEFAULT_REPORT_PREFIX)
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	task := &SchedulerTask{Name: "missing", Argv: []string{"/nonexistent/collector"}, BaseDir: dir}
+	task.Config.Store = "file"
+
+	_, err = RunWithoutTimeout(task)
+	assert.Error(t, err)
+	task.Timeout, task.GracePeriod = time.Second, time.Second
+	_, err = RunWithTimeout(task)
+	assert.Error(t, err)
+
+	files, err := ioutil.ReadDir(dir)
+	require.Nil(t, err)
+	assert.Empty(t, files)
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	log "github.com/sirupsen/logrus"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// DefaultShutdownGracePeriod is how long running collectors have to exit after a
+// SIGTERM when repeat shuts down, before they get a SIGKILL.
+const DefaultShutdownGracePeriod = 5 * time.Second
+
+// ProcessGroups tracks the process group of every running collector command, so
+// they can be terminated without signaling the process group of repeat itself.
+type ProcessGroups struct {
+	sync.Mutex
+	groups map[int]string
+}
+
+func NewProcessGroups() *ProcessGroups {
+	return &ProcessGroups{groups: make(map[int]string)}
+}
+
+func (pg *ProcessGroups) Add(pgid int, name string) {
+	pg.Lock()
+	defer pg.Unlock()
+	pg.groups[pgid] = name
+}
+
+func (pg *ProcessGroups) Remove(pgid int) {
+	pg.Lock()
+	defer pg.Unlock()
+	delete(pg.groups, pgid)
+}
+
+// Alive returns the tracked process groups that still have running processes.
+func (pg *ProcessGroups) Alive() map[int]string {
+	pg.Lock()
+	defer pg.Unlock()
+
+	alive := make(map[int]string)
+	for pgid, name := range pg.groups {
+		if IsProcessGroupAlive(pgid) {
+			alive[pgid] = name
+		} else {
+			delete(pg.groups, pgid)
+		}
+	}
+	return alive
+}
+
+// Terminate sends a SIGTERM to every tracked process group, and a SIGKILL to the
+// ones still running once the grace period expires.
+func (pg *ProcessGroups) Terminate(grace time.Duration) {
+	alive := pg.Alive()
+	for pgid, name := range alive {
+		log.Infof("Terminating process group: %d of collector %s", pgid, name)
+		KillProcessGroup(pgid, syscall.SIGTERM)
+	}
+
+	deadline := time.Now().Add(grace)
+	for len(alive) > 0 && time.Now().Before(deadline) {
+		time.Sleep(100 * time.Millisecond)
+		alive = pg.Alive()
+	}
+
+	for pgid, name := range alive {
+		log.Warnf("Process group: %d of collector %s still running after %s, killing it", pgid, name, grace)
+		KillProcessGroup(pgid, syscall.SIGKILL)
+		pg.Remove(pgid)
+	}
+}
+
+func IsProcessGroupAlive(pgid int) bool {
+	return syscall.Kill(-pgid, 0) == nil
+}
+
+func KillProcessGroup(pgid int, signal syscall.Signal) {
+	if err := syscall.Kill(-pgid, signal); err != nil && err != syscall.ESRCH {
+		log.Errorf("Error sending signal %s to process group: %d, error: %s", signal, pgid, err)
+	}
+}
+
+// TrackProcessGroup registers the process group of a started run. The returned function
+// must be called once the run command exited, it terminates any process left behind on
+// the group, which stays tracked until it is gone.
+func (task *SchedulerTask) TrackProcessGroup(pgid int) func() {
+	var groups *ProcessGroups
+	if task.Scheduler != nil && task.Scheduler.ProcessGroups != nil {
+		groups = task.Scheduler.ProcessGroups
+		groups.Add(pgid, task.Name)
+		// the run started while the scheduler was terminating the tracked groups.
+		if task.Scheduler.IsStopping() {
+			KillProcessGroup(pgid, syscall.SIGTERM)
+		}
+	}
+
+	return func() {
+		if IsProcessGroupAlive(pgid) {
+			log.Warnf("Collector %s left orphan processes on group: %d, terminating them", task.Name, pgid)
+			KillProcessGroup(pgid, syscall.SIGTERM)
+			return
+		}
+		if groups != nil {
+			groups.Remove(pgid)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	log "github.com/sirupsen/logrus"
+	"sync/atomic"
+)
+
+// QueuePolicy returns the policy applied when the insert queue is full.
+func (task *SchedulerTask) QueuePolicy() string {
+	if task.Scheduler == nil || task.Scheduler.Config == nil || task.Scheduler.Config.Queue.Policy == "" {
+		return QueueBlock
+	}
+	return task.Scheduler.Config.Queue.Policy
+}
+
+// Enqueue queues a record to be inserted into the database. When the queue is full the
+// record waits for room, replaces the oldest queued record or is dropped, depending on the
+// queue policy, and the delayed or dropped rows are accounted on the collector stats. The
+// queued runs are kept by the drop-oldest policy. It returns false if the record was dropped.
+func (task *SchedulerTask) Enqueue(record *InsertRecord) bool {
+	queue := *task.DBOpsQueue
+	select {
+	case queue <- record:
+		return true
+	default:
+	}
+
+	policy := task.QueuePolicy()
+	if atomic.CompareAndSwapInt32(&task.QueueFullReported, 0, 1) {
+		log.Warnf("Database insert queue is full (size: %d), collector %s rows are subject to the %s policy",
+			cap(queue), task.Name, policy)
+	}
+
+	switch policy {
+	case QueueDropNewest:
+		task.Stats.AddDropped()
+		return false
+	case QueueDropOldest:
+		for {
+			select {
+			case queue <- record:
+				return true
+			default:
+			}
+			select {
+			case dropped := <-queue:
+				// runs are never dropped, they are queued again behind the rows.
+				if dropped.TableName == RunHistoryTableName {
+					queue <- dropped
+					continue
+				}
+				task.accountDropped(dropped)
+			default:
+			}
+		}
+	default:
+		task.Stats.AddDelayed()
+		queue <- record
+		return true
+	}
+}
+
+// accountDropped adds a dropped record to the stats of the collector that produced it.
+func (task *SchedulerTask) accountDropped(record *InsertRecord) {
+	if record.dropped != nil {
+		record.dropped()
+	}
+	if task.Scheduler != nil {
+		if owner, ok := task.Scheduler.Tasks[record.Collector]; ok {
+			owner.Stats.AddDropped()
+			return
+		}
+	}
+	task.Stats.AddDropped()
+}
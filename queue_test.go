@@ -0,0 +1,75 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func newQueueTask(size int, policy string) (*SchedulerTask, chan *InsertRecord) {
+	queue := make(chan *InsertRecord, size)
+	scheduler := &Scheduler{Config: &Config{Queue: QueueConfig{Size: size, Policy: policy}}, Tasks: make(map[string]*SchedulerTask)}
+	task := &SchedulerTask{Name: "rows", DBOpsQueue: &queue, Scheduler: scheduler}
+	scheduler.Tasks[task.Name] = task
+	return task, queue
+}
+
+func TestEnqueueDropPolicies(t *testing.T) {
+	task, queue := newQueueTask(2, QueueDropNewest)
+	for i := 0; i < 3; i++ {
+		task.Enqueue(&InsertRecord{Collector: task.Name, Values: []interface{}{i}})
+	}
+	assert.Equal(t, 1, task.Stats.DroppedRows)
+	assert.Equal(t, 0, (<-queue).Values[0])
+	assert.Equal(t, 1, (<-queue).Values[0])
+
+	task, queue = newQueueTask(2, QueueDropOldest)
+	for i := 0; i < 3; i++ {
+		task.Enqueue(&InsertRecord{Collector: task.Name, Values: []interface{}{i}})
+	}
+	assert.Equal(t, 1, task.Stats.DroppedRows)
+	assert.Equal(t, 1, (<-queue).Values[0])
+	assert.Equal(t, 2, (<-queue).Values[0])
+}
+
+func TestEnqueueDropOldestKeepsRuns(t *testing.T) {
+	task, queue := newQueueTask(2, QueueDropOldest)
+	queue <- &InsertRecord{Collector: task.Name, TableName: RunHistoryTableName}
+	for i := 0; i < 2; i++ {
+		task.Enqueue(&InsertRecord{Collector: task.Name, TableName: task.Name, Values: []interface{}{i}})
+	}
+	assert.Equal(t, 1, task.Stats.DroppedRows)
+	assert.Equal(t, RunHistoryTableName, (<-queue).TableName)
+	assert.Equal(t, 1, (<-queue).Values[0])
+}
+
+func TestEnqueueBlocksUntilRoom(t *testing.T) {
+	task, queue := newQueueTask(1, QueueBlock)
+	task.Enqueue(&InsertRecord{Collector: task.Name})
+
+	enqueued := make(chan struct{})
+	go func() {
+		task.Enqueue(&InsertRecord{Collector: task.Name})
+		close(enqueued)
+	}()
+
+	select {
+	case <-enqueued:
+		t.Fatal("enqueue did not block on a full queue")
+	case <-time.After(100 * time.Millisecond):
+	}
+	<-queue
+	<-enqueued
+	assert.Equal(t, 1, task.Stats.DelayedRows)
+	assert.Equal(t, 0, task.Stats.DroppedRows)
+}
+
+func TestQueueConfigValidation(t *testing.T) {
+	config := QueueConfig{}
+	assert.Nil(t, config.SetDefaults())
+	assert.Equal(t, QueueBlock, config.Policy)
+	assert.Equal(t, 100000, config.Size)
+
+	config = QueueConfig{Policy: "drop-everything"}
+	assert.Error(t, config.SetDefaults())
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"sort"
+	"strings"
+	"time"
+)
+
+// DefaultMaintenanceInterval is how often the database writer applies the retention and
+// rollups of the collections during the session.
+const DefaultMaintenanceInterval = time.Minute
+
+// Rollup aggregates the rows of a collection table into a <table>_rollup_<interval> table,
+// with a row per interval and key holding the samples count and the min, max and average
+// of every field. Lag is how long after the end of an interval its rows can still arrive.
+type Rollup struct {
+	Table    *TaskTable
+	Name     string
+	Interval time.Duration
+	Lag      time.Duration
+	Key      []string
+	Fields   []string
+}
+
+// NewRollups returns the rollups of a collection, on its single table unless the
+// database tables are defined.
+func NewRollups(tables []*TaskTable, config DBConfig, lag time.Duration) ([]*Rollup, error) {
+	var rollups []*Rollup
+	for _, rollupConfig := range config.Rollup {
+		interval, err := time.ParseDuration(rollupConfig.Interval)
+		if err != nil {
+			return nil, err
+		}
+		var table *TaskTable
+		for _, candidate := range tables {
+			if rollupConfig.Table == "" || strings.EqualFold(candidate.Name, rollupConfig.Table) {
+				table = candidate
+				break
+			}
+		}
+		if table == nil {
+			return nil, fmt.Errorf("unknown rollup table: %s", rollupConfig.Table)
+		}
+		rollups = append(rollups, &Rollup{
+			Table:    table,
+			Name:     RollupTableName(table.Name, rollupConfig.Interval),
+			Interval: interval,
+			Lag:      lag,
+			Key:      rollupConfig.Key,
+			Fields:   rollupConfig.Fields,
+		})
+	}
+	return rollups, nil
+}
+
+// RollupTableName returns the table a rollup of the given table and interval is stored on.
+func RollupTableName(table, interval string) string {
+	return fmt.Sprintf("%s_rollup_%s", table, interval)
+}
+
+// Cutoff returns the end of the last complete interval at the given time, the one that
+// ended at least the lag ago, so its rows were already inserted.
+func (rollup *Rollup) Cutoff(now time.Time) time.Time {
+	return rollup.Truncate(now.Add(-rollup.Lag))
+}
+
+// Truncate returns the start of the interval the given time is in. Intervals are aligned
+// to the Unix epoch like the buckets computed by SQLite, time.Truncate aligns them to year
+// 1 instead, which differs for intervals that do not divide a day.
+func (rollup *Rollup) Truncate(at time.Time) time.Time {
+	seconds := int64(rollup.Interval / time.Second)
+	return time.Unix(at.Unix()/seconds*seconds, 0).UTC()
+}
+
+// RollupTable aggregates the rows of the source table of every interval that ended before
+// the cutoff and was not rolled up yet. Rolled up intervals are final, they are never
+// computed again, so the retention can remove their rows. It returns the number of rollup
+// rows written.
+func (db *DBStorage) RollupTable(rollup *Rollup, source string, cutoff time.Time) (int64, error) {
+	table := QuoteIdentifier(rollup.Name)
+	columns := []string{"bucket TEXT"}
+	var keys, aggregates []string
+	for _, name := range rollup.Key {
+		columns = append(columns, QuoteIdentifier(name))
+		keys = append(keys, QuoteIdentifier(name))
+	}
+	columns = append(columns, "samples INTEGER")
+	aggregates = append(aggregates, "count(*)")
+	for _, name := range rollup.Fields {
+		for _, function := range []string{"min", "max", "avg"} {
+			columns = append(columns, QuoteIdentifier(name+"_"+function)+" REAL")
+			aggregates = append(aggregates, fmt.Sprintf("%s(%s)", function, QuoteIdentifier(name)))
+		}
+	}
+	if err := db.Exec(fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (%s)", table, strings.Join(columns, ", "))).Error; err != nil {
+		return 0, err
+	}
+	if err := db.Exec(fmt.Sprintf("CREATE INDEX IF NOT EXISTS %s ON %s (bucket)",
+		QuoteIdentifier("idx_"+rollup.Name+"_bucket"), table)).Error; err != nil {
+		return 0, err
+	}
+
+	var last sql.NullString
+	if err := db.Raw(fmt.Sprintf("SELECT max(bucket) FROM %s", table)).Row().Scan(&last); err != nil {
+		return 0, err
+	}
+	// rows are rolled up from the end of the last rolled up interval.
+	from := ""
+	if last.Valid {
+		bucket, err := time.Parse(SQLiteDateTimeFormat, last.String)
+		if err != nil {
+			return 0, fmt.Errorf("invalid bucket: %s on table: %s", last.String, rollup.Name)
+		}
+		from = bucket.Add(rollup.Interval).Format(SQLiteDateTimeFormat)
+	}
+	until := cutoff.UTC().Format(SQLiteDateTimeFormat)
+	if until <= from {
+		return 0, nil
+	}
+
+	seconds := int64(rollup.Interval / time.Second)
+	bucket := fmt.Sprintf("strftime('%%Y-%%m-%%d %%H:%%M:%%f', CAST(strftime('%%s', created_at) AS INTEGER) / %d * %d, 'unixepoch')",
+		seconds, seconds)
+	groupBy := strings.Join(append([]string{"bucket"}, keys...), ", ")
+	query := db.Exec(fmt.Sprintf("INSERT INTO %s SELECT %s AS bucket, %s FROM %s WHERE created_at >= ? AND created_at < ? GROUP BY %s",
+		table, bucket, strings.Join(append(keys, aggregates...), ", "), QuoteIdentifier(source), groupBy), from, until)
+	return query.RowsAffected, query.Error
+}
+
+// DeleteOlderThan removes the rows of a table collected before the given time.
+func (db *DBStorage) DeleteOlderThan(table string, before time.Time) (int64, error) {
+	query := db.Exec(fmt.Sprintf("DELETE FROM %s WHERE created_at < ?", QuoteIdentifier(table)),
+		before.UTC().Format(SQLiteDateTimeFormat))
+	return query.RowsAffected, query.Error
+}
+
+// Maintain applies the rollups and then the retention of the collection tables. The final
+// pass runs once every queued record was inserted, so it rolls up every complete interval;
+// the rows of the current one are kept for a later session on a persistent database.
+func (scheduler *Scheduler) Maintain(now time.Time, final bool) {
+	var names []string
+	for name := range scheduler.Tasks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		task := scheduler.Tasks[name]
+		for _, rollup := range task.Rollups {
+			source, err := scheduler.DBStorage.CreateTable(rollup.Table.Name, rollup.Table.MapValues.Fields, rollup.Table.Indexes)
+			if err != nil {
+				log.Errorf("Collector %s, cannot roll up table %s: %s", name, rollup.Table.Name, err)
+				continue
+			}
+			cutoff := rollup.Cutoff(now)
+			if final {
+				cutoff = rollup.Truncate(now)
+			}
+			rows, err := scheduler.DBStorage.RollupTable(rollup, source, cutoff)
+			if err != nil {
+				log.Errorf("Collector %s, cannot roll up table %s into %s: %s", name, source, rollup.Name, err)
+				continue
+			}
+			log.Debugf("Collector %s, rolled up table %s into %s (%d rows)", name, source, rollup.Name, rows)
+		}
+
+		if task.Retention <= 0 {
+			continue
+		}
+		for _, table := range task.DBTables() {
+			source, err := scheduler.DBStorage.CreateTable(table.Name, table.MapValues.Fields, table.Indexes)
+			if err != nil {
+				log.Errorf("Collector %s, cannot apply the retention of table %s: %s", name, table.Name, err)
+				continue
+			}
+			rows, err := scheduler.DBStorage.DeleteOlderThan(source, now.Add(-task.Retention))
+			if err != nil {
+				log.Errorf("Collector %s, cannot apply the retention of table %s: %s", name, source, err)
+				continue
+			}
+			if rows > 0 {
+				log.Debugf("Collector %s, removed %d rows older than %s from table %s", name, rows, task.Retention, source)
+			}
+		}
+	}
+}
+
+// HasMaintenance reports whether any collection has a retention or rollups.
+func (scheduler *Scheduler) HasMaintenance() bool {
+	for _, task := range scheduler.Tasks {
+		if task.Retention > 0 || len(task.Rollups) > 0 {
+			return true
+		}
+	}
+	return false
+}
@@ -8,10 +8,9 @@ import (
 	"io/ioutil"
 	"os"
 	"os/exec"
-	"os/signal"
 	"path/filepath"
-	"strconv"
 	"strings"
+	"sync/atomic"
 	"syscall"
 	"time"
 )
@@ -26,32 +25,52 @@ type Scheduler struct {
 	Config                     *Config
 	DBStorage                  *DBStorage
 	GoCronScheduler            *gocron.Scheduler
-	Pgid                       int
 	Timeout                    *time.Duration
 	DBDir, BaseDir, ResultsDir string
 	Tasks                      map[string]*SchedulerTask
 	DBOpsQueue                 *chan *InsertRecord
-	Stopped                    bool
+	MaxConcurrent              int
+	Slots                      chan struct{}
+	RunAs                      string
+	ProcessGroups              *ProcessGroups
+	lifecycle                  *lifecycle
 }
 
 type SchedulerTask struct {
 	Name              string
 	RunEvery, Timeout time.Duration
 	Config            Collection
-	Pgid              int
 	Command           string
+	Argv              []string
 	Job               *gocron.Job
 	BaseDir           string
 	DBStorage         *DBStorage
 	DBOpsQueue        *chan *InsertRecord
 	Scheduler         *Scheduler
+	Running           chan struct{}
+	Queued            int32
+	RunCount          int64
+	RetryBackoff      time.Duration
+	GracePeriod       time.Duration
+	RestartDelay      time.Duration
+	FlushInterval     time.Duration
+	RotateSize        int64
+	MaxOutput         int64
+	ExitCodes         *ExitCodes
+	Tables            []*TaskTable
+	Rollups           []*Rollup
+	Retention         time.Duration
+	Limits            *ProcessLimits
+	LimitsReported    int32
+	QueueFullReported int32
+	Credential        *syscall.Credential
+	Breaker           CircuitBreaker
+	Stats             TaskStats
 }
 
 var Tempdir = ioutil.TempDir
 
-const DefaultOpsQueueSize = 100000000
-
-func NewScheduler(configFilename string, timeout *time.Duration, baseDir, resultsDir, dbDir string) (*Scheduler, error) {
+func NewScheduler(configFilename string, timeout *time.Duration, baseDir, resultsDir, dbDir string, maxConcurrent int, runAs string) (*Scheduler, error) {
 	var scheduler Scheduler
 	var t time.Location
 
@@ -66,26 +85,42 @@ func NewScheduler(configFilename string, timeout *time.Duration, baseDir, result
 		return nil, err
 	}
 
-	pgid, err := syscall.Getpgid(os.Getpid())
-	if err != nil {
-		return nil, err
-	}
-
-	opsQueue := make(chan *InsertRecord, DefaultOpsQueueSize)
+	log.Infof("Database insert queue size: %d, policy: %s", config.Queue.Size, config.Queue.Policy)
+	opsQueue := make(chan *InsertRecord, config.Queue.Size)
 
 	scheduler.BaseDir = tempDir
-	scheduler.Pgid = pgid
+	scheduler.ProcessGroups = NewProcessGroups()
+	scheduler.lifecycle = newLifecycle()
 	scheduler.Config = config
 	scheduler.GoCronScheduler = gocron.NewScheduler(&t)
 	scheduler.ResultsDir = resultsDir
 	scheduler.Tasks = make(map[string]*SchedulerTask)
 	scheduler.DBDir = dbDir
+	if dbDir == "" {
+		scheduler.DBDir = tempDir
+	}
 	scheduler.DBOpsQueue = &opsQueue
+	scheduler.MaxConcurrent = maxConcurrent
+	scheduler.RunAs = runAs
+
+	if maxConcurrent > 0 {
+		log.Infof("Scheduler max concurrent collector runs set to: %d", maxConcurrent)
+		scheduler.Slots = make(chan struct{}, maxConcurrent)
+	}
 
-	storage, err := NewDBStorage(scheduler.BaseDir)
+	if scheduler.IsPersistentDB() {
+		if err := os.MkdirAll(scheduler.DBDir, 0750); err != nil {
+			return nil, err
+		}
+		log.Infof("Using persistent database: %s", filepath.Join(scheduler.DBDir, DBFileName))
+	}
+	storage, err := NewDBStorage(scheduler.DBDir)
 	if err != nil {
 		return nil, err
 	}
+	if err := storage.StartSession(configFilename); err != nil {
+		return nil, err
+	}
 	scheduler.DBStorage = storage
 
 	if timeout != nil {
@@ -96,6 +131,9 @@ func NewScheduler(configFilename string, timeout *time.Duration, baseDir, result
 	if err = scheduler.LoadTasks(); err != nil {
 		return nil, err
 	}
+	if err = scheduler.DescribeCollections(); err != nil {
+		return nil, fmt.Errorf("cannot write the data dictionary: %s", err)
+	}
 
 	return &scheduler, nil
 }
@@ -113,6 +151,31 @@ func (scheduler *Scheduler) LoadTasks() error {
 	return nil
 }
 
+// IsPersistentDB reports whether the database is kept outside of the report directory.
+func (scheduler *Scheduler) IsPersistentDB() bool {
+	return scheduler.DBDir != scheduler.BaseDir
+}
+
+// CloseDB finishes the database session, a persistent database is snapshotted into
+// the report directory so the tarball includes it.
+func (scheduler *Scheduler) CloseDB() error {
+	if err := scheduler.DBStorage.FinishSession(); err != nil {
+		log.Errorf("Cannot finish database session: %s", err)
+	}
+	scheduler.DBStorage.CreateViews(scheduler.Config.Views)
+	if err := scheduler.DBStorage.Checkpoint(); err != nil {
+		log.Errorf("Cannot checkpoint the database: %s", err)
+	}
+	if scheduler.IsPersistentDB() {
+		snapshot := filepath.Join(scheduler.BaseDir, DBFileName)
+		log.Infof("Copying persistent database into the report: %s", snapshot)
+		if err := scheduler.DBStorage.Snapshot(snapshot); err != nil {
+			return err
+		}
+	}
+	return scheduler.DBStorage.Close()
+}
+
 func (scheduler *Scheduler) TarballReport() error {
 	reportFileName := filepath.Join(scheduler.ResultsDir,
 		fmt.Sprintf("%sreport-%s.tar.gz", DEFAULT_REPORT_PREFIX, time.Now().Format("2006-01-02-15-04")))
@@ -122,7 +185,8 @@ func (scheduler *Scheduler) TarballReport() error {
 	}
 	var filesToAppend []string
 	for _, file := range files {
-		if !strings.Contains(file, "db-journal") {
+		// the WAL is checkpointed and removed once the database is closed.
+		if !strings.HasSuffix(file, "-journal") && !strings.HasSuffix(file, "-wal") && !strings.HasSuffix(file, "-shm") {
 			filesToAppend = append(filesToAppend, file)
 		}
 	}
@@ -134,14 +198,35 @@ func (scheduler *Scheduler) TarballReport() error {
 	return nil
 }
 
+// Cleanup stops the session: no new runs are started, running collectors are terminated,
+// the pending records are inserted and the report tarball is created.
 func (scheduler *Scheduler) Cleanup() error {
 	log.Info("Cleaning up resources")
 
-	scheduler.GoCronScheduler.Clear()
+	scheduler.Stop("cleanup")
+	// the jobs are only cleared once the gocron loop is stopped, it reads them on every tick.
 	scheduler.GoCronScheduler.Stop()
-	scheduler.Stopped = true
+	scheduler.GoCronScheduler.Clear()
+	scheduler.ProcessGroups.Terminate(DefaultShutdownGracePeriod)
+	scheduler.WaitForRuns()
 
 	close(*scheduler.DBOpsQueue)
+	if scheduler.lifecycle.inserted != nil {
+		log.Infof("Waiting for %d queued records to be inserted", len(*scheduler.DBOpsQueue))
+		<-scheduler.lifecycle.inserted
+	}
+
+	if scheduler.HasMaintenance() {
+		scheduler.Maintain(time.Now(), true)
+	}
+
+	if err := scheduler.WriteSummary(); err != nil {
+		log.Errorf("Cannot write session summary: %s", err)
+	}
+
+	if err := scheduler.CloseDB(); err != nil {
+		log.Errorf("Cannot close the database: %s", err)
+	}
 
 	if err := scheduler.TarballReport(); err != nil {
 		return err
@@ -155,23 +240,11 @@ func (scheduler *Scheduler) Cleanup() error {
 	return nil
 }
 
-func (scheduler *Scheduler) HandleTimeout() {
-	timer := time.NewTimer(*scheduler.Timeout)
-	defer timer.Stop()
-
-	for range timer.C {
-		log.Infof("Scheduler timeout (%f) reached, cleaning up and killing process", scheduler.Timeout.Seconds())
-		if err := scheduler.Cleanup(); err != nil {
-			log.Error(err)
-		}
-		if err := syscall.Kill(-scheduler.Pgid, syscall.SIGKILL); err != nil {
-			log.Errorf("Error killing process group: %d", scheduler.Pgid)
-			os.Exit(-1)
-		}
-	}
-}
-
 func (scheduler *Scheduler) RemoveTask(name string) {
+	// the jobs are cleared by Cleanup, they cannot be changed while the gocron loop stops.
+	if scheduler.IsStopping() {
+		return
+	}
 	if task, ok := scheduler.Tasks[name]; !ok {
 		log.Debugf("Not found available task with name: %s in scheduler", name)
 	} else {
@@ -180,107 +253,331 @@ func (scheduler *Scheduler) RemoveTask(name string) {
 	}
 }
 
+// AcquireRun applies the overlap policy of the task and the global max-concurrent limit.
+// It returns the function that releases the acquired slots, or nil and the reason
+// why the run has to be skipped.
+func (scheduler *Scheduler) AcquireRun(task *SchedulerTask) (func(), string) {
+	switch task.Config.Overlap {
+	case OverlapSkip:
+		select {
+		case task.Running <- struct{}{}:
+		default:
+			return nil, "previous run still in progress"
+		}
+	case OverlapQueue:
+		if atomic.AddInt32(&task.Queued, 1) > 1 {
+			atomic.AddInt32(&task.Queued, -1)
+			return nil, "previous run still in progress and another run is already queued"
+		}
+		select {
+		case task.Running <- struct{}{}:
+			atomic.AddInt32(&task.Queued, -1)
+		case <-scheduler.Done():
+			atomic.AddInt32(&task.Queued, -1)
+			return nil, "scheduler is stopping"
+		}
+	}
+
+	releaseTask := func() {
+		if task.Config.Overlap != OverlapAllow {
+			<-task.Running
+		}
+	}
+
+	if scheduler.Slots == nil {
+		return releaseTask, ""
+	}
+
+	if task.Config.Overlap == OverlapSkip {
+		select {
+		case scheduler.Slots <- struct{}{}:
+		default:
+			releaseTask()
+			return nil, fmt.Sprintf("max-concurrent limit (%d) reached", scheduler.MaxConcurrent)
+		}
+	} else {
+		select {
+		case scheduler.Slots <- struct{}{}:
+		case <-scheduler.Done():
+			releaseTask()
+			return nil, "scheduler is stopping"
+		}
+	}
+
+	return func() {
+		<-scheduler.Slots
+		releaseTask()
+	}, ""
+}
+
 var WriteFile = ioutil.WriteFile
 
 func (scheduler *Scheduler) RunTask(task *SchedulerTask) error {
-	var output []byte
-	var err error
-
 	if task.Config.RunOnce {
 		scheduler.RemoveTask(task.Name)
 	}
 
-	if task.Timeout > 0 {
-		output, err = RunWithTimeout(task)
+	if !scheduler.BeginRun() {
+		log.Debugf("Not running collector %s, scheduler is stopping", task.Name)
+		return nil
+	}
+	defer scheduler.EndRun()
+
+	release, reason := scheduler.AcquireRun(task)
+	if release == nil {
+		log.Warnf("Skipping run of collector %s, %s (overlap: %s)", task.Name, reason, task.Config.Overlap)
+		scheduler.RecordSkippedRun(task, reason)
+		return nil
+	}
+	defer release()
+
+	run := &RunHistory{RunID: scheduler.NewRunID(task), Collector: task.Name, StartedAt: time.Now()}
+	allowed, probe := task.Breaker.Allow(run.StartedAt)
+	if !allowed {
+		log.Debugf("Skipping run of collector %s, circuit breaker is open", task.Name)
+		scheduler.RecordSkippedRun(task, "circuit breaker open")
+		return nil
+	}
+	if probe {
+		log.Infof("Circuit breaker for collector %s is open, probing with a single run", task.Name)
+	}
+
+	result, err := scheduler.runTask(task, run, !probe)
+	if result != nil {
+		run.Stderr = string(result.Stderr)
+	}
+	if err != nil {
+		if task.Breaker.Failure(time.Now()) {
+			task.Stats.AddBreakerTrip()
+			log.Errorf("Collector %s failed %d consecutive times, circuit breaker open, disabled for %s",
+				task.Name, task.Breaker.Threshold, task.Breaker.ProbeAfter)
+		} else if probe {
+			log.Warnf("Probe run of collector %s failed, circuit breaker remains open for %s",
+				task.Name, task.Breaker.ProbeAfter)
+		}
+		run.Status, run.Reason = RunStatusFailed, err.Error()
 	} else {
-		output, err = RunWithoutTimeout(task)
+		if task.Breaker.Success() {
+			log.Infof("Collector %s recovered, circuit breaker closed", task.Name)
+		}
+		run.Status = RunStatusSuccess
+		if result.TimedOut {
+			run.Status, run.Reason = RunStatusTimeout, fmt.Sprintf("timed out after %s, partial output stored", task.Timeout)
+		} else if result.Truncated {
+			run.Reason = fmt.Sprintf("output truncated at max-output of %d bytes", task.MaxOutput)
+		}
 	}
+	run.FinishedAt = time.Now()
+	task.Stats.Record(run.Status)
+	scheduler.RecordRun(run)
+	return err
+}
 
-	if err != nil && !task.IsValidExitCode(err) {
-		errMsg := fmt.Errorf("Command for collector %s exited with exit code: %s - (not allowed by exit-codes config)",
-			task.Name, err.Error())
-		log.Error(errMsg)
-		return errMsg
+func (scheduler *Scheduler) RecordSkippedRun(task *SchedulerTask, reason string) {
+	now := time.Now()
+	task.Stats.Record(RunStatusSkipped)
+	scheduler.RecordRun(&RunHistory{
+		RunID: scheduler.NewRunID(task), Collector: task.Name, Status: RunStatusSkipped, Reason: reason, StartedAt: now, FinishedAt: now,
+	})
+}
+
+// RecordRun queues the run to the database writer, runs are never dropped by the queue
+// policy. Runs are stored right away while the writer is not started.
+func (scheduler *Scheduler) RecordRun(run *RunHistory) {
+	if scheduler.lifecycle == nil || scheduler.lifecycle.inserted == nil {
+		scheduler.DBStorage.RecordRun(run)
+		return
+	}
+	*scheduler.DBOpsQueue <- scheduler.DBStorage.RunRecord(run)
+}
+
+// NewRunID returns the identifier of a new run of the task, stored along with every
+// row the run produces.
+func (scheduler *Scheduler) NewRunID(task *SchedulerTask) string {
+	var session uint
+	if scheduler.DBStorage != nil {
+		session = scheduler.DBStorage.SessionID
+	}
+	return fmt.Sprintf("%d-%s-%d", session, task.Name, atomic.AddInt64(&task.RunCount, 1))
+}
+
+// runTask executes the task command, retrying it with an exponential backoff
+// if allowed, and stores its results.
+func (scheduler *Scheduler) runTask(task *SchedulerTask, run *RunHistory, retry bool) (*RunResult, error) {
+	result, err := task.Execute()
+	for attempt := 1; err != nil && retry && attempt <= task.Config.Retries; attempt++ {
+		backoff := task.RetryBackoff * time.Duration(1<<uint(attempt-1))
+		log.Warnf("Retrying collector %s in %s (attempt %d of %d)", task.Name, backoff, attempt, task.Config.Retries)
+		task.Stats.AddRetry()
+		if !scheduler.Sleep(backoff) {
+			break
+		}
+		result, err = task.Execute()
 	}
+	if err != nil {
+		return result, err
+	}
+	result.RunID, result.StartedAt = run.RunID, run.StartedAt
 
 	switch task.Config.Store {
 	case "database":
 		{
-			return task.StoreResultsToDB(output)
+			return result, task.StoreResultsToDB(result)
 		}
 	case "file":
 		{
-			return task.StoreResultsToFile(output)
+			return result, task.StoreResultsToFile(result)
 		}
 	}
-	return nil
+	return result, nil
 }
 
+// DefaultFlushCheckInterval is how often the buffered records are checked against
+// the flush-interval of their collector.
+const DefaultFlushCheckInterval = time.Second
+
+// MaxTransactionRows is the maximum number of queued records taken at once by the
+// writer, the due batches of all the tables are inserted on a single transaction.
+const MaxTransactionRows = 50000
+
+// WaitForRecordsToInsert is the single database writer, it inserts the queued records in
+// batches, a batch is flushed once it reaches the batch-size or its oldest record waited
+// for the flush-interval of the collector. It returns once the queue is closed and every
+// remaining record has been inserted.
 func (scheduler *Scheduler) WaitForRecordsToInsert(ch *chan *InsertRecord) {
 	var RecordsMap = make(map[string][]*InsertRecord)
-	for {
-		record := <-*ch
-		if record == nil {
-			continue
+	var bufferedSince = make(map[string]time.Time)
+	var batchSizes = make(map[string]int)
+	var flushIntervals = make(map[string]time.Duration)
+	var inserted int
+
+	var add = func(record *InsertRecord) {
+		batchSize, flushInterval := 1, time.Duration(0)
+		if task, ok := scheduler.Tasks[record.Collector]; ok && record.TableName != RunHistoryTableName {
+			batchSize, flushInterval = task.Config.BatchSize, task.FlushInterval
+		}
+		if len(RecordsMap[record.TableName]) == 0 {
+			bufferedSince[record.TableName] = time.Now()
 		}
+		batchSizes[record.TableName], flushIntervals[record.TableName] = batchSize, flushInterval
 		RecordsMap[record.TableName] = append(RecordsMap[record.TableName], record)
-		batchSize := scheduler.Config.Collections[record.TableName].BatchSize
 		log.Tracef("Records on table %s -- records: %d - batchsize: %d", record.TableName, len(RecordsMap[record.TableName]), batchSize)
+	}
 
-		if len(RecordsMap[record.TableName]) >= batchSize || scheduler.Stopped {
-			var dst strings.Builder
-			dst.WriteString("INSERT INTO ")
-			dst.WriteString("main." + record.TableName)
-			dst.WriteString(" (")
-			dst.WriteString(strings.Join(record.FieldNames, ", "))
-			dst.WriteString(") VALUES ")
-
-			for i, r := range RecordsMap[record.TableName] {
-				dst.WriteString("(" + strings.Join(r.Values, ", ") + ")")
-				if i == len(RecordsMap[record.TableName])-1 {
-					dst.WriteString(";")
-				} else {
-					dst.WriteString(",")
-				}
+	var flush = func(all bool, now time.Time) {
+		batches := make(map[string][]*InsertRecord)
+		rows := 0
+		for tableName, records := range RecordsMap {
+			interval := flushIntervals[tableName]
+			if all || len(records) >= batchSizes[tableName] || (interval > 0 && now.Sub(bufferedSince[tableName]) >= interval) {
+				batches[tableName] = records
+				rows += len(records)
+				delete(RecordsMap, tableName)
+				delete(bufferedSince, tableName)
 			}
+		}
+		if len(batches) == 0 {
+			return
+		}
+
+		count, err := scheduler.DBStorage.InsertBatches(batches)
+		if err != nil {
+			log.Errorf("Error inserting %d records: %s", rows, err)
+		}
+		inserted += count
+		log.Debugf("Inserted %d records into %d tables, remaining elements on channel to be processed: %d",
+			count, len(batches), len(*ch))
+	}
+
+	// the retention and rollups are applied by the writer too, between batches.
+	maintenance, maintainedAt := scheduler.HasMaintenance(), time.Now()
+
+	ticker := time.NewTicker(DefaultFlushCheckInterval)
+	defer ticker.Stop()
 
-			if err := scheduler.DBStorage.Exec(dst.String()).Error; err != nil {
-				log.Errorf("Error executing database query: %s", err)
+	for {
+		select {
+		case record, ok := <-*ch:
+			closed := !ok
+			if ok {
+				add(record)
+			}
+			// take the records already queued, so they are written on the same transaction.
+		drain:
+			for taken := 1; !closed && taken < MaxTransactionRows; taken++ {
+				select {
+				case record, ok := <-*ch:
+					if !ok {
+						closed = true
+						break drain
+					}
+					add(record)
+				default:
+					break drain
+				}
 			}
 
-			log.Debugf("Remaining elements on channel to be processed: %d", len(*ch))
-			log.Tracef("Executed query: %s", dst.String())
-			RecordsMap[record.TableName] = make([]*InsertRecord, 0)
+			if closed {
+				pending := 0
+				for _, records := range RecordsMap {
+					pending += len(records)
+				}
+				flush(true, time.Now())
+				log.Infof("Database queue drained, %d records inserted (%d pending at shutdown)", inserted, pending)
+				return
+			}
+			flush(false, time.Now())
+		case now := <-ticker.C:
+			flush(false, now)
+			if maintenance && now.Sub(maintainedAt) >= DefaultMaintenanceInterval {
+				scheduler.Maintain(now, false)
+				maintainedAt = now
+			}
 		}
 	}
 }
 
+// Start schedules every collector and blocks until the session is stopped by the
+// scheduler timeout, a termination signal or an error, then it cleans up.
 func (scheduler *Scheduler) Start() error {
+	scheduler.lifecycle.inserted = make(chan struct{})
+	go func() {
+		scheduler.WaitForRecordsToInsert(scheduler.DBOpsQueue)
+		close(scheduler.lifecycle.inserted)
+	}()
+
 	for name, task := range scheduler.Tasks {
+		if task.Config.Mode == ModeStream {
+			log.Infof("Starting %s collector in stream mode", name)
+			if scheduler.BeginRun() {
+				go func(task *SchedulerTask) {
+					defer scheduler.EndRun()
+					scheduler.RunStream(task)
+				}(task)
+			}
+			continue
+		}
 		log.Infof("Scheduling run of %s collector every %f secs", name, task.RunEvery.Seconds())
 		job, err := scheduler.GoCronScheduler.Every(uint64(task.RunEvery.Seconds())).Seconds().StartImmediately().Do(scheduler.RunTask, task)
 		if err != nil {
+			scheduler.Stop(fmt.Sprintf("cannot schedule collector %s: %s", name, err))
+			if cleanupErr := scheduler.Cleanup(); cleanupErr != nil {
+				log.Errorf("Error during the cleanup phase: %s", cleanupErr)
+			}
 			return err
 		}
 		scheduler.Tasks[name].Job = job
 	}
 
-	scheduler.GoCronScheduler.StartAsync()
-
-	if *scheduler.Timeout > 0 {
-		go scheduler.HandleTimeout()
+	if scheduler.HasMaintenance() {
+		log.Infof("Applying retention and rollups every %f secs", DefaultMaintenanceInterval.Seconds())
 	}
 
-	go scheduler.WaitForRecordsToInsert(scheduler.DBOpsQueue)
-
-	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	scheduler.GoCronScheduler.StartAsync()
+	scheduler.WaitForStop()
 
-	for range c {
-		if err := scheduler.Cleanup(); err != nil {
-			log.Errorf("Error during the cleanup phase: %s", err)
-		}
-		os.Exit(1)
+	if err := scheduler.Cleanup(); err != nil {
+		return fmt.Errorf("error during the cleanup phase: %s", err)
 	}
 	return nil
 }
@@ -290,6 +587,7 @@ var TempFile = ioutil.TempFile
 func NewSchedulerTask(name string, collection Collection, scheduler *Scheduler) (*SchedulerTask, error) {
 	var task SchedulerTask
 	var command string
+	var argv []string
 
 	runEvery, err := time.ParseDuration(collection.RunEvery)
 	if err != nil {
@@ -301,10 +599,74 @@ func NewSchedulerTask(name string, collection Collection, scheduler *Scheduler)
 		return nil, err
 	}
 
+	retryBackoff, err := time.ParseDuration(collection.RetryBackoff)
+	if err != nil {
+		return nil, err
+	}
+
+	gracePeriod, err := time.ParseDuration(collection.Grace)
+	if err != nil {
+		return nil, err
+	}
+
+	probeAfter, err := time.ParseDuration(collection.CircuitBreaker.ProbeAfter)
+	if err != nil {
+		return nil, err
+	}
+
+	restartDelay, err := time.ParseDuration(collection.Stream.RestartDelay)
+	if err != nil {
+		return nil, err
+	}
+
+	flushInterval, err := time.ParseDuration(collection.Flush)
+	if err != nil {
+		return nil, err
+	}
+
+	rotateSize, err := ParseSize(collection.Stream.RotateSize)
+	if err != nil {
+		return nil, err
+	}
+
+	maxOutput, err := ParseSize(collection.MaxOutput)
+	if err != nil {
+		return nil, err
+	}
+
+	exitCodes, err := ParseExitCodes(collection.ExitCodes)
+	if err != nil {
+		return nil, fmt.Errorf("task: %s, %s", name, err)
+	}
+
+	limits, err := NewProcessLimits(collection)
+	if err != nil {
+		return nil, fmt.Errorf("task: %s, %s", name, err)
+	}
+
 	if collection.RunOnce && runEvery > 0 {
 		return nil, fmt.Errorf("task: %s must be defined as run-once or run-every, not both", name)
 	}
 
+	runAs := collection.User
+	if runAs == "" {
+		runAs = scheduler.RunAs
+	}
+	credential, err := LookupCredential(runAs, collection.Group)
+	if err != nil {
+		return nil, fmt.Errorf("task: %s, %s", name, err)
+	}
+	if credential != nil {
+		log.Infof("Collector %s will run as uid: %d gid: %d", name, credential.Uid, credential.Gid)
+		// let unprivileged collectors reach their working directory.
+		if err := os.Chmod(scheduler.BaseDir, 0711); err != nil {
+			return nil, err
+		}
+		if err := CheckCredential(credential, scheduler.BaseDir); err != nil {
+			return nil, fmt.Errorf("task: %s, %s", name, err)
+		}
+	}
+
 	if collection.Script != "" {
 		fd, err := TempFile(scheduler.BaseDir, "run-script-")
 		if err != nil {
@@ -313,88 +675,276 @@ func NewSchedulerTask(name string, collection Collection, scheduler *Scheduler)
 		if err = fd.Chmod(0700); err != nil {
 			return nil, err
 		}
+		if credential != nil {
+			if err = fd.Chown(int(credential.Uid), int(credential.Gid)); err != nil {
+				return nil, err
+			}
+		}
 		if _, err = fd.WriteString(collection.Script); err != nil {
 			return nil, err
 		}
 
 		fd.Close()
 		command = fd.Name()
+		if collection.Interpreter != "" {
+			argv = append(strings.Fields(collection.Interpreter), command)
+		}
+	} else if len(collection.Argv) > 0 {
+		argv = collection.Argv
+		command = strings.Join(argv, " ")
 	} else {
 		command = collection.Command
 	}
 
 	task.BaseDir = scheduler.BaseDir
 	task.Command = command
+	task.Argv = argv
 	task.Timeout = taskTimeout
 	task.RunEvery = runEvery
 	task.Config = collection
 	task.Name = name
-	task.Pgid = scheduler.Pgid
+	if task.Tables, err = NewTaskTables(task.TableName(), collection.Database); err != nil {
+		return nil, fmt.Errorf("task: %s, %s", name, err)
+	}
+	if task.Rollups, err = NewRollups(task.Tables, collection.Database, flushInterval+DefaultFlushCheckInterval); err != nil {
+		return nil, fmt.Errorf("task: %s, %s", name, err)
+	}
+	if collection.Database.Retention != "" {
+		if task.Retention, err = time.ParseDuration(collection.Database.Retention); err != nil {
+			return nil, fmt.Errorf("task: %s, %s", name, err)
+		}
+	}
 	task.DBStorage = scheduler.DBStorage
 	task.DBOpsQueue = scheduler.DBOpsQueue
 	task.Scheduler = scheduler
+	task.Running = make(chan struct{}, 1)
+	task.RetryBackoff = retryBackoff
+	task.GracePeriod = gracePeriod
+	task.RestartDelay = restartDelay
+	task.FlushInterval = flushInterval
+	task.RotateSize = rotateSize
+	task.MaxOutput = maxOutput
+	task.ExitCodes = exitCodes
+	task.Limits = limits
+	task.Credential = credential
+	task.Breaker.Threshold = collection.CircuitBreaker.Failures
+	task.Breaker.ProbeAfter = probeAfter
 	return &task, nil
 }
 
+// Execute runs the task command, it fails if the exit code is not allowed by exit-codes.
+func (task *SchedulerTask) Execute() (*RunResult, error) {
+	var result *RunResult
+	var err error
+
+	if task.Timeout > 0 {
+		result, err = RunWithTimeout(task)
+	} else {
+		result, err = RunWithoutTimeout(task)
+	}
+
+	if result != nil && result.Aborted {
+		err = fmt.Errorf("Command for collector %s aborted, output exceeded max-output of %d bytes",
+			task.Name, task.MaxOutput)
+		log.Error(err)
+		task.DiscardResult(result)
+		return result, err
+	}
+
+	if result == nil || (err != nil && !result.TimedOut && !task.IsValidExitCode(err)) {
+		errMsg := fmt.Errorf("Command for collector %s exited with exit code: %s - (not allowed by exit-codes config)",
+			task.Name, err.Error())
+		log.Error(errMsg)
+		task.DiscardResult(result)
+		return result, errMsg
+	}
+	return result, nil
+}
+
+// DiscardResult removes the result file of a failed run, if any.
+func (task *SchedulerTask) DiscardResult(result *RunResult) {
+	if result == nil || result.OutputFile == "" {
+		return
+	}
+	if err := os.Remove(result.OutputFile); err != nil {
+		log.Errorf("Cannot remove results file %s of collector %s: %s", result.OutputFile, task.Name, err)
+	}
+	result.OutputFile = ""
+}
+
 func (task *SchedulerTask) IsValidExitCode(err error) bool {
-	if task.Config.ExitCodes == DEFAULT_ANY_EXIT_CODE {
-		return true
-	}
-	if exitError, ok := err.(*exec.ExitError); ok {
-		for _, exitCode := range strings.Split(task.Config.ExitCodes, " ") {
-			code, _ := strconv.Atoi(exitCode)
-			if code == exitError.ExitCode() {
-				return true
-			}
+	return task.ExitCodes.MatchesError(err)
+}
+
+// TableName returns the database.name of the collection, or the collection name in lowercase.
+func (task *SchedulerTask) TableName() string {
+	if task.Config.Database.Name != "" {
+		return task.Config.Database.Name
+	}
+	return strings.ToLower(task.Name)
+}
+
+// StoreLineToDB maps a single output line into a record of every task table it matches.
+func (task *SchedulerTask) StoreLineToDB(line string, row RowContext) error {
+	if strings.TrimSpace(line) == "" {
+		return nil
+	}
+	var storeErr error
+	for _, table := range task.DBTables() {
+		if table.Match != nil && !table.Match.MatchString(line) {
+			continue
+		}
+		values := strings.Split(line, table.MapValues.Separator)
+		fields := table.MapValues.Fields
+		name, err := task.DBStorage.CreateTable(table.Name, fields, table.Indexes)
+		if err == nil {
+			err = task.DBStorage.CreateRecord(task, table, name, values, row)
+		}
+		if err != nil && storeErr == nil {
+			storeErr = err
 		}
 	}
-	return false
+	return storeErr
 }
 
-func (task *SchedulerTask) StoreResultsToDB(results []byte) error {
-	tableName := strings.ToLower(task.Name)
-	for _, line := range strings.Split(string(results), "\n") {
-		values := strings.Split(line, task.Config.Database.MapValues.Separator)
-		fields := task.Config.Database.MapValues.Fields
-		task.DBStorage.CreateTable(tableName, fields)
-		if err := task.DBStorage.CreateRecord(task, tableName, fields, values); err != nil {
+func (task *SchedulerTask) StoreResultsToDB(result *RunResult) error {
+	tableNames := task.TableNames()
+	if result.TimedOut || result.Truncated {
+		log.Warnf("Collector %s output is partial (timed out: %t, truncated: %t), storing into database, table: %s",
+			task.Name, result.TimedOut, result.Truncated, tableNames)
+	}
+	for _, line := range strings.Split(string(result.Output), "\n") {
+		if err := task.StoreLineToDB(line, RowContext{RunID: result.RunID, CollectedAt: result.StartedAt}); err != nil {
 			return err
 		}
 	}
-	log.Infof("Command for collector %s, successfully ran, stored results into database, table: %s", task.Name, tableName)
+	log.Infof("Command for collector %s, successfully ran, stored results into database, table: %s", task.Name, tableNames)
 	return nil
 }
 
-func (task *SchedulerTask) StoreResultsToFile(results []byte) error {
-	outputFileName := filepath.Join(task.BaseDir, fmt.Sprintf("%s-%s", task.Name, time.Now().Format("2006-01-02-15:04:05")))
-	if err := WriteFile(outputFileName, results, 0750); err != nil {
-		log.Errorf("Error storing collection results for %s, on file: %s", task.Name, outputFileName)
-		return err
+func (task *SchedulerTask) StoreResultsToFile(result *RunResult) error {
+	outputFileName := result.OutputFile
+	if outputFileName == "" {
+		outputFileName = task.ResultFileName()
+		if err := WriteFile(outputFileName, result.Output, 0750); err != nil {
+			log.Errorf("Error storing collection results for %s, on file: %s", task.Name, outputFileName)
+			return err
+		}
+	}
+
+	if result.TimedOut || result.Truncated {
+		flaggedFileName := outputFileName
+		if result.TimedOut {
+			flaggedFileName += TimedOutSuffix
+		}
+		if result.Truncated {
+			flaggedFileName += TruncatedSuffix
+		}
+		if err := os.Rename(outputFileName, flaggedFileName); err != nil {
+			log.Errorf("Error flagging collection results for %s, on file: %s", task.Name, outputFileName)
+			return err
+		}
+		outputFileName = flaggedFileName
+	}
+	if len(result.Stderr) > 0 {
+		if err := WriteFile(outputFileName+StderrSuffix, result.Stderr, 0750); err != nil {
+			log.Errorf("Error storing collection stderr for %s, on file: %s", task.Name, outputFileName+StderrSuffix)
+			return err
+		}
 	}
 	log.Infof("Command for collector %s, successfully ran, stored results into file: %s", task.Name, outputFileName)
 	return nil
 }
 
-func RunWithTimeout(task *SchedulerTask) ([]byte, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), task.Timeout)
+// CommandArgs returns the argv executed for the task, commands without an explicit
+// argv or interpreter are run through bash -c.
+func (task *SchedulerTask) CommandArgs() []string {
+	if len(task.Argv) > 0 {
+		return task.Argv
+	}
+	return []string{"bash", "-c", task.Command}
+}
+
+// RunWithTimeout runs the task command on its own process group. Once the timeout expires the
+// whole group receives a SIGTERM, followed by a SIGKILL if it is still alive after the grace
+// period. The output produced until then is returned flagged as timed out.
+func RunWithTimeout(task *SchedulerTask) (*RunResult, error) {
+	var timedOut int32
+
+	// the context deadline is only a last resort, the process group is signaled before. The
+	// command is also killed once the session is cancelled.
+	ctx, cancel := context.WithTimeout(task.Scheduler.Context(), task.Timeout+task.GracePeriod+time.Second)
 	defer cancel()
-	cmd := ExecCommandContext(ctx, "bash", "-c", task.Command)
+	argv, gate, err := task.LimitedCommandArgs()
+	if err != nil {
+		return nil, err
+	}
+	cmd := ExecCommandContext(ctx, argv[0], argv[1:]...)
 	cmd.Dir = task.BaseDir
-	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true, Pgid: task.Pgid}
+	cmd.SysProcAttr = task.SysProcAttr()
+	gate.Attach(cmd)
+	defer gate.Open()
+	capture, err := NewOutputCapture(task, cmd)
+	if err != nil {
+		return nil, err
+	}
+	defer capture.Close()
 
 	log.Infof("Running command for collector %s", task.Name)
-	output, err := cmd.CombinedOutput()
-	if ctx.Err() == context.DeadlineExceeded {
-		log.Warnf("Collector: %s, timed out after %f secs (cancelled)", task.Name, task.Timeout.Seconds())
-		return nil, nil
+	if err := cmd.Start(); err != nil {
+		capture.Discard()
+		return nil, err
+	}
+	defer task.TrackProcessGroup(cmd.Process.Pid)()
+	defer task.ApplyLimits(gate, cmd.Process.Pid)()
+
+	terminate := time.AfterFunc(task.Timeout, func() {
+		atomic.StoreInt32(&timedOut, 1)
+		log.Warnf("Collector: %s, timed out after %f secs, sending SIGTERM (grace period: %s)",
+			task.Name, task.Timeout.Seconds(), task.GracePeriod)
+		KillProcessGroup(cmd.Process.Pid, syscall.SIGTERM)
+	})
+	kill := time.AfterFunc(task.Timeout+task.GracePeriod, func() {
+		log.Warnf("Collector: %s, still running after the grace period, sending SIGKILL", task.Name)
+		KillProcessGroup(cmd.Process.Pid, syscall.SIGKILL)
+	})
+
+	err = cmd.Wait()
+	terminate.Stop()
+	kill.Stop()
+
+	result := capture.Result()
+	result.TimedOut = atomic.LoadInt32(&timedOut) == 1
+	if result.TimedOut {
+		return result, nil
 	}
-	return output, err
+	return result, err
 }
 
-func RunWithoutTimeout(task *SchedulerTask) ([]byte, error) {
-	cmd := ExecCommand("bash", "-c", task.Command)
+func RunWithoutTimeout(task *SchedulerTask) (*RunResult, error) {
+	argv, gate, err := task.LimitedCommandArgs()
+	if err != nil {
+		return nil, err
+	}
+	cmd := ExecCommand(argv[0], argv[1:]...)
 	cmd.Dir = task.BaseDir
-	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true, Pgid: task.Pgid}
+	cmd.SysProcAttr = task.SysProcAttr()
+	gate.Attach(cmd)
+	defer gate.Open()
+	capture, err := NewOutputCapture(task, cmd)
+	if err != nil {
+		return nil, err
+	}
+	defer capture.Close()
+
 	log.Infof("Running command for collector %s", task.Name)
-	return cmd.CombinedOutput()
+	if err := cmd.Start(); err != nil {
+		capture.Discard()
+		return nil, err
+	}
+	defer task.TrackProcessGroup(cmd.Process.Pid)()
+	defer task.ApplyLimits(gate, cmd.Process.Pid)()
+
+	err = cmd.Wait()
+	return capture.Result(), err
 }
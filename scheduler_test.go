@@ -5,12 +5,14 @@ import (
 	log "github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
 	"path/filepath"
 
 	"io/ioutil"
 	"os"
 	"os/exec"
 	"path"
+	"syscall"
 	"testing"
 	"time"
 )
@@ -60,18 +62,431 @@ func init() {
 }
 
 func TestRunSchedulerTask(t *testing.T) {
-	scheduler, err := NewScheduler(DefaultConfigPath, &DefaultSchedulerTimeOut, DefaultBaseDir, DefaultBaseDir, ".")
+	scheduler, err := NewScheduler(DefaultConfigPath, &DefaultSchedulerTimeOut, DefaultBaseDir, DefaultBaseDir, "", 0, "")
 	assert.Nil(t, err)
 	assert.Len(t, scheduler.Tasks, 5)
 
-	defer os.RemoveAll(scheduler.ResultsDir)
+	defer os.RemoveAll(scheduler.BaseDir)
 
 	err = scheduler.RunTask(scheduler.Tasks["test"])
 	assert.Nil(t, err)
 
 	files, _ := filepath.Glob(scheduler.BaseDir + "/test*")
-	assert.NotEmpty(t, files)
+	require.NotEmpty(t, files)
 	assert.FileExists(t, files[0])
 	output, _ := ioutil.ReadFile(files[0])
 	assert.EqualValues(t, output, []byte(DEFAULT_COMMAND_OUTPUT))
 }
+
+func TestAcquireRunOverlapPolicies(t *testing.T) {
+	scheduler := &Scheduler{MaxConcurrent: 1, Slots: make(chan struct{}, 1)}
+
+	skip := &SchedulerTask{Name: "skip", Config: Collection{Overlap: OverlapSkip}, Running: make(chan struct{}, 1)}
+	release, reason := scheduler.AcquireRun(skip)
+	assert.NotNil(t, release)
+	assert.Empty(t, reason)
+
+	again, reason := scheduler.AcquireRun(skip)
+	assert.Nil(t, again)
+	assert.Contains(t, reason, "previous run still in progress")
+
+	other := &SchedulerTask{Name: "other", Config: Collection{Overlap: OverlapSkip}, Running: make(chan struct{}, 1)}
+	limited, reason := scheduler.AcquireRun(other)
+	assert.Nil(t, limited)
+	assert.Contains(t, reason, "max-concurrent")
+
+	release()
+	release, reason = scheduler.AcquireRun(other)
+	assert.NotNil(t, release)
+	assert.Empty(t, reason)
+	release()
+}
+
+func TestCircuitBreakerOpensAndProbes(t *testing.T) {
+	breaker := CircuitBreaker{Threshold: 2, ProbeAfter: time.Minute}
+	now := time.Now()
+
+	assert.False(t, breaker.Failure(now))
+	assert.True(t, breaker.Failure(now))
+	assert.True(t, breaker.IsOpen())
+
+	allowed, probe := breaker.Allow(now.Add(time.Second))
+	assert.False(t, allowed)
+	assert.False(t, probe)
+
+	allowed, probe = breaker.Allow(now.Add(2 * time.Minute))
+	assert.True(t, allowed)
+	assert.True(t, probe)
+
+	assert.True(t, breaker.Success())
+	assert.False(t, breaker.IsOpen())
+}
+
+func TestRunWithTimeoutKeepsPartialOutput(t *testing.T) {
+	defer func(execCommandContext func(context.Context, string, ...string) *exec.Cmd) {
+		ExecCommandContext = execCommandContext
+	}(ExecCommandContext)
+	ExecCommandContext = exec.CommandContext
+
+	dir, err := ioutil.TempDir("", DEFAULT_REPORT_PREFIX)
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	task := &SchedulerTask{
+		Name:        "slow",
+		Command:     "echo partial; sleep 10",
+		Timeout:     200 * time.Millisecond,
+		GracePeriod: 200 * time.Millisecond,
+		BaseDir:     dir,
+	}
+
+	started := time.Now()
+	result, err := RunWithTimeout(task)
+	require.Nil(t, err)
+	assert.True(t, result.TimedOut)
+	assert.Equal(t, "partial\n", string(result.Output))
+	assert.True(t, time.Since(started) < 5*time.Second)
+}
+
+func TestRunWithTimeoutStopsWithTheSession(t *testing.T) {
+	defer func(execCommandContext func(context.Context, string, ...string) *exec.Cmd) {
+		ExecCommandContext = execCommandContext
+	}(ExecCommandContext)
+	ExecCommandContext = exec.CommandContext
+
+	dir, err := ioutil.TempDir("", DEFAULT_REPORT_PREFIX)
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	scheduler := &Scheduler{lifecycle: newLifecycle()}
+	task := &SchedulerTask{Name: "slow", Command: "exec sleep 10", Timeout: 10 * time.Second,
+		GracePeriod: time.Second, BaseDir: dir, Scheduler: scheduler}
+	time.AfterFunc(200*time.Millisecond, func() { scheduler.Stop("test") })
+
+	started := time.Now()
+	_, err = RunWithTimeout(task)
+	assert.Error(t, err)
+	assert.True(t, time.Since(started) < 5*time.Second)
+}
+
+func TestRunWithoutTimeoutSeparatesStderr(t *testing.T) {
+	dir, err := ioutil.TempDir("", DEFAULT_REPORT_PREFIX)
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	task := &SchedulerTask{Name: "stderr", Command: "echo out; echo err >&2", BaseDir: dir}
+
+	result, err := RunWithoutTimeout(task)
+	require.Nil(t, err)
+	assert.Equal(t, "out\n", string(result.Output))
+	assert.Equal(t, "err\n", string(result.Stderr))
+
+	task.Config.MergeStderr = true
+	result, err = RunWithoutTimeout(task)
+	require.Nil(t, err)
+	assert.Equal(t, "out\nerr\n", string(result.Output))
+	assert.Empty(t, result.Stderr)
+}
+
+func TestSchedulerTaskArgvAndInterpreter(t *testing.T) {
+	dir, err := ioutil.TempDir("", DEFAULT_REPORT_PREFIX)
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	scheduler := &Scheduler{BaseDir: dir}
+
+	collection := Collection{Argv: []string{"echo", "no shell $HOME"}, Store: "database"}
+	assert.Nil(t, collection.SetDefaults())
+	task, err := NewSchedulerTask("argv", collection, scheduler)
+	assert.Nil(t, err)
+	result, err := task.Execute()
+	assert.Nil(t, err)
+	assert.Equal(t, "no shell $HOME\n", string(result.Output))
+
+	collection = Collection{Script: "BEGIN { print \"from awk\" }", Interpreter: "awk -f", Store: "database"}
+	assert.Nil(t, collection.SetDefaults())
+	task, err = NewSchedulerTask("awk", collection, scheduler)
+	assert.Nil(t, err)
+	result, err = task.Execute()
+	assert.Nil(t, err)
+	assert.Equal(t, "from awk\n", string(result.Output))
+
+	collection = Collection{Command: "ps aux", Interpreter: "python3"}
+	assert.Error(t, collection.SetDefaults())
+}
+
+func TestRunAppliesProcessLimits(t *testing.T) {
+	collection := Collection{Nice: 5, Rlimits: RlimitsConfig{OpenFiles: 64}}
+	limits, err := NewProcessLimits(collection)
+	require.Nil(t, err)
+	dir, err := ioutil.TempDir("", DEFAULT_REPORT_PREFIX)
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	task := &SchedulerTask{Name: "limited", Command: "ulimit -n; nice; sh -c 'ulimit -n'", BaseDir: dir, Limits: limits}
+	result, err := RunWithoutTimeout(task)
+	require.Nil(t, err)
+	assert.Equal(t, "64\n5\n64\n", string(result.Output))
+	assert.Equal(t, "nice=5 rlimit-open-files=64", task.Stats.Limits)
+
+	_, err = NewProcessLimits(Collection{IONice: "lazy"})
+	assert.Error(t, err)
+}
+
+func TestSchedulerTaskRunAsUser(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("dropping credentials requires root")
+	}
+	dir, err := ioutil.TempDir("", DEFAULT_REPORT_PREFIX)
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	scheduler := &Scheduler{BaseDir: dir, RunAs: "nobody"}
+
+	collection := Collection{Script: "id -un", Store: "database"}
+	assert.Nil(t, collection.SetDefaults())
+	task, err := NewSchedulerTask("unprivileged", collection, scheduler)
+	assert.Nil(t, err)
+	result, err := task.Execute()
+	assert.Nil(t, err)
+	assert.Equal(t, "nobody\n", string(result.Output))
+
+	collection = Collection{Command: "id -u", Store: "database", User: "root"}
+	assert.Nil(t, collection.SetDefaults())
+	task, err = NewSchedulerTask("privileged", collection, scheduler)
+	assert.Nil(t, err)
+	result, err = task.Execute()
+	assert.Nil(t, err)
+	assert.Equal(t, "0\n", string(result.Output))
+}
+
+func TestCheckCredential(t *testing.T) {
+	defer func(geteuid, getegid func() int) {
+		Geteuid, Getegid = geteuid, getegid
+	}(Geteuid, Getegid)
+	Geteuid, Getegid = func() int { return 1000 }, func() int { return 1000 }
+
+	dir, err := ioutil.TempDir("", DEFAULT_REPORT_PREFIX)
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	// running as the current identity does not need privileges.
+	credential := &syscall.Credential{Uid: 1000, Gid: 1000, Groups: []uint32{1000, 27}}
+	assert.Nil(t, CheckCredential(credential, "/"))
+	assert.True(t, credential.NoSetGroups)
+	assert.Error(t, CheckCredential(&syscall.Credential{Uid: 65534, Gid: 65534}, "/"))
+
+	// the temporary directory is only reachable by its owner.
+	Geteuid, Getegid = func() int { return 0 }, func() int { return 0 }
+	base := filepath.Join(dir, "base")
+	require.Nil(t, os.Mkdir(base, 0711))
+	assert.Error(t, CheckCredential(&syscall.Credential{Uid: 65534, Gid: 65534}, base))
+	assert.Nil(t, CheckCredential(&syscall.Credential{Uid: 0, Gid: 0}, base))
+	require.Nil(t, os.Chmod(dir, 0711))
+	assert.Nil(t, CheckCredential(&syscall.Credential{Uid: 65534, Gid: 65534}, base))
+}
+
+func TestRunTerminatesOrphanProcesses(t *testing.T) {
+	dir, err := ioutil.TempDir("", DEFAULT_REPORT_PREFIX)
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	scheduler := &Scheduler{ProcessGroups: NewProcessGroups()}
+	task := &SchedulerTask{Name: "orphans", Command: "sleep 30 >/dev/null 2>&1 & echo $!", BaseDir: dir,
+		Scheduler: scheduler}
+
+	_, err = RunWithoutTimeout(task)
+	require.Nil(t, err)
+
+	scheduler.ProcessGroups.Terminate(time.Second)
+	assert.Empty(t, scheduler.ProcessGroups.Alive())
+}
+
+func TestSchedulerStartStopsOnTimeout(t *testing.T) {
+	resultsDir, err := ioutil.TempDir("", DEFAULT_REPORT_PREFIX)
+	assert.Nil(t, err)
+	defer os.RemoveAll(resultsDir)
+
+	timeout := time.Second
+	scheduler, err := NewScheduler(DefaultConfigPath, &timeout, resultsDir, resultsDir, "", 0, "")
+	assert.Nil(t, err)
+
+	started := time.Now()
+	assert.Nil(t, scheduler.Start())
+	assert.True(t, time.Since(started) < 10*time.Second)
+	assert.True(t, scheduler.IsStopping())
+	assert.False(t, scheduler.BeginRun())
+
+	reports, _ := filepath.Glob(filepath.Join(resultsDir, DEFAULT_REPORT_PREFIX+"report-*.tar.gz"))
+	assert.Len(t, reports, 1)
+	assert.NoDirExists(t, scheduler.BaseDir)
+}
+
+func TestWaitForRecordsToInsertFlushes(t *testing.T) {
+	dir, err := ioutil.TempDir("", DEFAULT_REPORT_PREFIX)
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	db, err := NewDBStorage(dir)
+	assert.Nil(t, err)
+	defer db.Close()
+
+	queue := make(chan *InsertRecord, 10)
+	scheduler := &Scheduler{DBStorage: db, DBOpsQueue: &queue, Tasks: make(map[string]*SchedulerTask)}
+	task := &SchedulerTask{Name: "Load", DBStorage: db, DBOpsQueue: &queue, FlushInterval: time.Second}
+	task.Config.BatchSize = 100
+	task.Config.Database.MapValues = MapValue{Separator: " ", Fields: []MapValueField{{Name: "value", Index: 0, Type: "int"}}}
+	scheduler.Tasks[task.Name] = task
+
+	inserted := make(chan struct{})
+	go func() {
+		scheduler.WaitForRecordsToInsert(&queue)
+		close(inserted)
+	}()
+
+	var count = func() (rows int) {
+		db.Table(task.TableName()).Count(&rows)
+		return rows
+	}
+
+	assert.Nil(t, task.StoreResultsToDB(&RunResult{Output: []byte("1\n2\n")}))
+	assert.Eventually(t, func() bool { return count() == 2 }, 5*time.Second, 100*time.Millisecond)
+
+	assert.Nil(t, task.StoreResultsToDB(&RunResult{Output: []byte("3\n")}))
+	close(queue)
+	<-inserted
+	assert.Equal(t, 3, count())
+}
+
+func TestSchedulerPersistentDatabase(t *testing.T) {
+	resultsDir, err := ioutil.TempDir("", DEFAULT_REPORT_PREFIX)
+	assert.Nil(t, err)
+	defer os.RemoveAll(resultsDir)
+	dbDir := filepath.Join(resultsDir, "db")
+
+	timeout := time.Second
+	for session := 0; session < 2; session++ {
+		scheduler, err := NewScheduler(DefaultConfigPath, &timeout, resultsDir, resultsDir, dbDir, 0, "")
+		assert.Nil(t, err)
+		assert.True(t, scheduler.IsPersistentDB())
+		assert.Nil(t, scheduler.Start())
+		assert.FileExists(t, filepath.Join(dbDir, DBFileName))
+	}
+
+	db, err := NewDBStorage(dbDir)
+	assert.Nil(t, err)
+	defer db.Close()
+
+	var sessions []Session
+	assert.Nil(t, db.Order("id").Find(&sessions).Error)
+	assert.Len(t, sessions, 2)
+	for _, session := range sessions {
+		assert.False(t, session.FinishedAt.IsZero())
+	}
+}
+
+func TestRunTaskStoresCollectionTimeAndRunID(t *testing.T) {
+	dir, err := ioutil.TempDir("", DEFAULT_REPORT_PREFIX)
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	db, err := NewDBStorage(dir)
+	assert.Nil(t, err)
+	defer db.Close()
+
+	queue := make(chan *InsertRecord, 10)
+	scheduler := &Scheduler{DBStorage: db, DBOpsQueue: &queue, Tasks: make(map[string]*SchedulerTask)}
+	task := &SchedulerTask{Name: "samples", Command: "echo 1; sleep 1; echo 2", BaseDir: dir, DBStorage: db, DBOpsQueue: &queue}
+	task.Config.Store = "database"
+	task.Config.BatchSize = 100
+	task.Config.Database.MapValues = MapValue{Separator: " ", Fields: []MapValueField{{Name: "value", Index: 0, Type: "int"}}}
+	scheduler.Tasks[task.Name] = task
+
+	run := &RunHistory{RunID: scheduler.NewRunID(task), StartedAt: time.Date(2020, 1, 2, 3, 4, 5, 678000000, time.UTC)}
+	_, err = scheduler.runTask(task, run, false)
+	assert.Nil(t, err)
+	close(queue)
+	scheduler.WaitForRecordsToInsert(&queue)
+
+	type row struct {
+		CreatedAt string
+		RunID     string
+	}
+	var rows []row
+	assert.Nil(t, db.Raw("SELECT CAST(created_at AS TEXT) AS created_at, run_id FROM samples").Scan(&rows).Error)
+	assert.Equal(t, []row{{"2020-01-02 03:04:05.678", "0-samples-1"}, {"2020-01-02 03:04:05.678", "0-samples-1"}}, rows)
+}
+
+func TestRecordRunThroughTheWriter(t *testing.T) {
+	dir, err := ioutil.TempDir("", DEFAULT_REPORT_PREFIX)
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	db, err := NewDBStorage(dir)
+	require.Nil(t, err)
+	defer db.Close()
+
+	queue := make(chan *InsertRecord, 10)
+	scheduler := &Scheduler{DBStorage: db, DBOpsQueue: &queue, Tasks: make(map[string]*SchedulerTask), lifecycle: newLifecycle()}
+	scheduler.lifecycle.inserted = make(chan struct{})
+	started := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	scheduler.RecordRun(&RunHistory{RunID: "0-samples-1", Collector: "samples", Status: RunStatusSuccess,
+		StartedAt: started, FinishedAt: started.Add(1500 * time.Millisecond)})
+	require.Len(t, queue, 1)
+	close(queue)
+	scheduler.WaitForRecordsToInsert(&queue)
+
+	var runs []RunHistory
+	require.Nil(t, db.Find(&runs).Error)
+	require.Len(t, runs, 1)
+	assert.Equal(t, "0-samples-1", runs[0].RunID)
+	assert.Equal(t, int64(1500), runs[0].DurationMs)
+	assert.True(t, runs[0].StartedAt.Equal(started))
+}
+
+func TestMaintainRollupIntervalLongerThanMaintenance(t *testing.T) {
+	dir, err := ioutil.TempDir("", DEFAULT_REPORT_PREFIX)
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	db, err := NewDBStorage(dir)
+	require.Nil(t, err)
+	defer db.Close()
+
+	collection := Collection{Command: "true", Store: "database", Database: DBConfig{
+		MapValues: MapValue{Fields: []MapValueField{{Name: "value", Index: 0, Type: "int"}}},
+		Retention: "1h", Rollup: []RollupConfig{{Interval: "1h", Fields: []string{"value"}}}}}
+	assert.NotNil(t, collection.SetDefaults())
+	collection.Database.Retention = "2h"
+	require.Nil(t, collection.SetDefaults())
+
+	scheduler := &Scheduler{BaseDir: dir, DBStorage: db, Tasks: make(map[string]*SchedulerTask)}
+	task, err := NewSchedulerTask("samples", collection, scheduler)
+	require.Nil(t, err)
+	scheduler.Tasks[task.Name] = task
+
+	table, err := db.CreateTable("samples", task.Tables[0].MapValues.Fields, task.Tables[0].Indexes)
+	require.Nil(t, err)
+	var indexes int
+	require.Nil(t, db.Raw("SELECT count(*) FROM sqlite_master WHERE type = 'index' AND tbl_name = ? AND sql LIKE '%created_at%'",
+		table).Row().Scan(&indexes))
+	assert.Equal(t, 1, indexes)
+
+	// a row every minute, maintained every minute, for three hours.
+	start := time.Date(2020, 5, 6, 8, 0, 0, 0, time.UTC)
+	for minute := 0; minute < 180; minute++ {
+		now := start.Add(time.Duration(minute) * time.Minute)
+		_, err := db.InsertBatch(table, []*InsertRecord{{FieldNames: []string{"created_at", "value"},
+			Values: []interface{}{now.Format(SQLiteDateTimeFormat), minute}}})
+		require.Nil(t, err)
+		scheduler.Maintain(now.Add(time.Second), false)
+	}
+
+	type bucket struct {
+		Bucket  string
+		Samples int
+	}
+	var buckets []bucket
+	require.Nil(t, db.Raw("SELECT bucket, samples FROM samples_rollup_1h ORDER BY bucket").Scan(&buckets).Error)
+	assert.Equal(t, []bucket{{"2020-05-06 08:00:00.000", 60}, {"2020-05-06 09:00:00.000", 60}}, buckets)
+
+	var oldest string
+	require.Nil(t, db.Raw("SELECT CAST(min(created_at) AS TEXT) FROM samples").Row().Scan(&oldest))
+	assert.Equal(t, "2020-05-06 09:00:00.000", oldest)
+}
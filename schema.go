@@ -0,0 +1,115 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"sort"
+	"time"
+)
+
+const SchemasTableName = "_repeat_schemas"
+
+// TableSchema records every version of the fields definition used by a collection table,
+// rows of different versions are never mixed on the same table unless the newer version
+// only adds fields.
+type TableSchema struct {
+	ID        uint `gorm:"primary_key"`
+	Name      string
+	Table     string
+	Version   int
+	Hash      string
+	Fields    string
+	SessionID uint
+	CreatedAt time.Time
+}
+
+func (TableSchema) TableName() string {
+	return SchemasTableName
+}
+
+func fieldTypes(fields []MapValueField) map[string]string {
+	types := make(map[string]string)
+	for _, field := range fields {
+		if field.Timestamp {
+			types[field.Name] = "timestamp"
+		} else {
+			types[field.Name] = field.Type
+		}
+	}
+	return types
+}
+
+// SchemaHash identifies a fields definition by the name and type of its fields, the
+// field-index does not change the table schema.
+func SchemaHash(fields []MapValueField) (string, string, error) {
+	types := fieldTypes(fields)
+	var names []string
+	for name := range types {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var definition []map[string]string
+	for _, name := range names {
+		definition = append(definition, map[string]string{"name": name, "type": types[name]})
+	}
+	encoded, err := json.Marshal(definition)
+	if err != nil {
+		return "", "", err
+	}
+	return fmt.Sprintf("%x", sha256.Sum256(encoded))[:16], string(encoded), nil
+}
+
+// IsAdditiveSchemaChange reports whether the new fields keep every previous field with
+// the same type, so the existing table can be migrated by adding columns.
+func IsAdditiveSchemaChange(previous string, fields []MapValueField) bool {
+	var definition []map[string]string
+	if err := json.Unmarshal([]byte(previous), &definition); err != nil {
+		return false
+	}
+	types := fieldTypes(fields)
+	for _, field := range definition {
+		if fieldType, ok := types[field["name"]]; !ok || fieldType != field["type"] {
+			return false
+		}
+	}
+	return true
+}
+
+// ResolveSchema returns the schema to be used for the given fields on a collection table:
+// the current one if the fields did not change, a new version on the same table if fields
+// were only added, or a new version on a versioned table otherwise. The second value is
+// true when the returned schema has to be recorded.
+func (db *DBStorage) ResolveSchema(tableName string, fields []MapValueField) (*TableSchema, bool, error) {
+	hash, definition, err := SchemaHash(fields)
+	if err != nil {
+		return nil, false, err
+	}
+
+	var current TableSchema
+	query := db.Where("name = ?", tableName).Order("version desc").First(&current)
+	if query.RecordNotFound() {
+		return &TableSchema{Name: tableName, Table: tableName, Version: 1, Hash: hash, Fields: definition}, true, nil
+	}
+	if query.Error != nil {
+		return nil, false, query.Error
+	}
+	if current.Hash == hash {
+		return &current, false, nil
+	}
+
+	schema := TableSchema{Name: tableName, Version: current.Version + 1, Hash: hash, Fields: definition}
+	if IsAdditiveSchemaChange(current.Fields, fields) {
+		schema.Table = current.Table
+		log.Infof("Schema of table %s changed (version %d -> %d), adding the new columns to table %s",
+			tableName, current.Version, schema.Version, schema.Table)
+	} else {
+		schema.Table = fmt.Sprintf("%s_v%d", tableName, schema.Version)
+		log.Warnf("Schema of table %s changed (version %d -> %d), fields were renamed, removed or retyped, "+
+			"storing rows on new table %s, previous rows are kept on table %s",
+			tableName, current.Version, schema.Version, schema.Table, current.Table)
+	}
+	return &schema, true, nil
+}
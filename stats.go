@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const SummaryFileName = "summary.txt"
+
+// TaskStats accumulates the outcome of every run of a collector during the session.
+type TaskStats struct {
+	sync.Mutex
+	Runs, Succeeded, Failed, Skipped, TimedOut, Retries, BreakerTrips int
+	DroppedRows, DelayedRows, UnchangedRows                           int
+	Limits                                                            string
+}
+
+func (stats *TaskStats) Record(status string) {
+	stats.Lock()
+	defer stats.Unlock()
+
+	switch status {
+	case RunStatusSuccess:
+		stats.Runs++
+		stats.Succeeded++
+	case RunStatusFailed:
+		stats.Runs++
+		stats.Failed++
+	case RunStatusSkipped:
+		stats.Skipped++
+	case RunStatusTimeout:
+		stats.Runs++
+		stats.TimedOut++
+	}
+}
+
+func (stats *TaskStats) AddRetry() {
+	stats.Lock()
+	defer stats.Unlock()
+	stats.Retries++
+}
+
+func (stats *TaskStats) AddDropped() {
+	stats.Lock()
+	defer stats.Unlock()
+	stats.DroppedRows++
+}
+
+func (stats *TaskStats) AddDelayed() {
+	stats.Lock()
+	defer stats.Unlock()
+	stats.DelayedRows++
+}
+
+func (stats *TaskStats) AddUnchanged() {
+	stats.Lock()
+	defer stats.Unlock()
+	stats.UnchangedRows++
+}
+
+func (stats *TaskStats) AddBreakerTrip() {
+	stats.Lock()
+	defer stats.Unlock()
+	stats.BreakerTrips++
+}
+
+// CircuitBreaker disables a collector after a number of consecutive failures, and lets
+// a single probe run go through once the probe-after period has elapsed.
+type CircuitBreaker struct {
+	sync.Mutex
+	Threshold  int
+	ProbeAfter time.Duration
+	Failures   int
+	OpenUntil  time.Time
+}
+
+func (cb *CircuitBreaker) IsOpen() bool {
+	cb.Lock()
+	defer cb.Unlock()
+	return cb.Threshold > 0 && cb.Failures >= cb.Threshold
+}
+
+// Allow reports whether a run can go through at the given time, and whether
+// that run is a probe of an open breaker.
+func (cb *CircuitBreaker) Allow(now time.Time) (allowed bool, probe bool) {
+	cb.Lock()
+	defer cb.Unlock()
+
+	if cb.Threshold <= 0 || cb.Failures < cb.Threshold {
+		return true, false
+	}
+	if now.Before(cb.OpenUntil) {
+		return false, false
+	}
+	// push the next probe forward, so only one run probes at a time.
+	cb.OpenUntil = now.Add(cb.ProbeAfter)
+	return true, true
+}
+
+// Success resets the breaker, it returns true if the breaker was open.
+func (cb *CircuitBreaker) Success() bool {
+	cb.Lock()
+	defer cb.Unlock()
+
+	wasOpen := cb.Threshold > 0 && cb.Failures >= cb.Threshold
+	cb.Failures = 0
+	return wasOpen
+}
+
+// Failure accounts a failed run, it returns true if this failure opened the breaker.
+func (cb *CircuitBreaker) Failure(now time.Time) bool {
+	cb.Lock()
+	defer cb.Unlock()
+
+	cb.Failures++
+	if cb.Threshold <= 0 || cb.Failures < cb.Threshold {
+		return false
+	}
+	cb.OpenUntil = now.Add(cb.ProbeAfter)
+	return cb.Failures == cb.Threshold
+}
+
+func (scheduler *Scheduler) Summary() string {
+	var names []string
+	for name := range scheduler.Tasks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var summary strings.Builder
+	for _, name := range names {
+		task := scheduler.Tasks[name]
+		task.Stats.Lock()
+		breaker := "closed"
+		if task.Breaker.IsOpen() {
+			breaker = "open"
+		}
+		summary.WriteString(fmt.Sprintf(
+			"collector: %s runs: %d succeeded: %d failed: %d skipped: %d timed-out: %d retries: %d breaker-trips: %d breaker: %s"+
+				" dropped-rows: %d delayed-rows: %d unchanged-rows: %d",
+			name, task.Stats.Runs, task.Stats.Succeeded, task.Stats.Failed, task.Stats.Skipped,
+			task.Stats.TimedOut, task.Stats.Retries, task.Stats.BreakerTrips, breaker,
+			task.Stats.DroppedRows, task.Stats.DelayedRows, task.Stats.UnchangedRows))
+		if task.Stats.Limits != "" {
+			summary.WriteString(" limits: " + task.Stats.Limits)
+		}
+		summary.WriteString("\n")
+		task.Stats.Unlock()
+	}
+	return summary.String()
+}
+
+// WriteSummary logs the session summary and stores it in the report directory.
+func (scheduler *Scheduler) WriteSummary() error {
+	summary := scheduler.Summary()
+	for _, line := range strings.Split(summary, "\n") {
+		if line != "" {
+			log.Infof("Session summary: %s", line)
+		}
+	}
+	return WriteFile(filepath.Join(scheduler.BaseDir, SummaryFileName), []byte(summary), 0640)
+}
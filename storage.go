@@ -6,33 +6,171 @@ import (
 	_ "github.com/go-orm/gorm/dialects/sqlite"
 	dynamicstruct "github.com/ompluscator/dynamic-struct"
 	log "github.com/sirupsen/logrus"
+	"os"
 	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
+// SQLiteDateTimeFormat is the format of the collection times, in UTC with millisecond
+// precision, understood by the sqlite date and time functions.
+const SQLiteDateTimeFormat = "2006-01-02 15:04:05.000"
+
+const (
+	DBFileName          = "collections.db"
+	SessionsTableName   = "sessions"
+	RunHistoryTableName = "run_history"
+
+	RunStatusSuccess = "success"
+	RunStatusFailed  = "failed"
+	RunStatusSkipped = "skipped"
+	RunStatusTimeout = "timeout"
+)
+
+// Session identifies every execution of repeat that stored results on the database,
+// a persistent database keeps one row per session.
+type Session struct {
+	ID         uint `gorm:"primary_key"`
+	Hostname   string
+	ConfigFile string
+	StartedAt  time.Time
+	FinishedAt time.Time
+}
+
+func (Session) TableName() string {
+	return SessionsTableName
+}
+
+// RunHistory keeps track of every scheduled invocation of a collector, including the skipped ones.
+type RunHistory struct {
+	ID         uint `gorm:"primary_key"`
+	SessionID  uint
+	RunID      string `gorm:"index"`
+	Collector  string
+	Status     string
+	Reason     string
+	Stderr     string
+	StartedAt  time.Time
+	FinishedAt time.Time
+	DurationMs int64
+}
+
+func (RunHistory) TableName() string {
+	return RunHistoryTableName
+}
+
 type DBStorage struct {
 	*gorm.DB
-	Tables map[string]bool
+	Tables    map[string]string
+	SessionID uint
+	lock      sync.Mutex
 }
 
+// DBOptions opens the database in WAL mode, which lets the report be read while the
+// collectors write and turns commits into appends, with synchronous=NORMAL as the WAL
+// keeps the database consistent on crashes.
+const DBOptions = "?_journal_mode=WAL&_synchronous=NORMAL&_busy_timeout=5000"
+
+// NewDBStorage opens the collections database on the given directory, an existing
+// database is reused so results are appended across sessions.
 func NewDBStorage(dBPath string) (*DBStorage, error) {
-	db, err := gorm.Open("sqlite3", path.Join(dBPath, "collections.db"))
+	db, err := gorm.Open("sqlite3", path.Join(dBPath, DBFileName)+DBOptions)
 	if err != nil {
 		return nil, err
 	}
-	return &DBStorage{DB: db, Tables: make(map[string]bool)}, nil
+	// sqlite allows a single writer, sharing one connection serializes the writes of the
+	// collectors with the batches of the insert writer instead of failing with busy errors.
+	db.DB().SetMaxOpenConns(1)
+	if err := db.AutoMigrate(&Session{}, &RunHistory{}, &TableSchema{}, &CollectionInfo{}, &ColumnInfo{}).Error; err != nil {
+		return nil, err
+	}
+	return &DBStorage{DB: db, Tables: make(map[string]string)}, nil
+}
+
+// StartSession registers a new session, the rows stored afterwards are tagged with its id.
+func (db *DBStorage) StartSession(configFile string) error {
+	hostname, _ := os.Hostname()
+	session := Session{Hostname: hostname, ConfigFile: configFile, StartedAt: time.Now()}
+	if err := db.Create(&session).Error; err != nil {
+		return err
+	}
+	db.SessionID = session.ID
+	log.Infof("Started database session: %d", session.ID)
+	return nil
+}
+
+func (db *DBStorage) FinishSession() error {
+	return db.Model(&Session{ID: db.SessionID}).Update("finished_at", time.Now()).Error
+}
+
+// Checkpoint moves the content of the WAL file into the database file and truncates it.
+func (db *DBStorage) Checkpoint() error {
+	return db.Exec("PRAGMA wal_checkpoint(TRUNCATE)").Error
+}
+
+// Snapshot writes a consistent copy of the database into the given file.
+func (db *DBStorage) Snapshot(fileName string) error {
+	return db.Exec("VACUUM INTO ?", fileName).Error
+}
+
+// RecordRun stores the run right away, the scheduler queues runs to the database writer
+// instead once it is started, see Scheduler.RecordRun.
+func (db *DBStorage) RecordRun(run *RunHistory) {
+	run.SessionID = db.SessionID
+	run.DurationMs = run.FinishedAt.Sub(run.StartedAt).Nanoseconds() / int64(time.Millisecond)
+	if err := db.Create(run).Error; err != nil {
+		log.Errorf("Cannot record run of collector %s on %s table: %s", run.Collector, RunHistoryTableName, err)
+	}
 }
 
-func (db *DBStorage) CreateTable(tableName string, fields []MapValueField) {
+// RunRecord returns the row of the run to be inserted by the database writer.
+func (db *DBStorage) RunRecord(run *RunHistory) *InsertRecord {
+	run.SessionID = db.SessionID
+	run.DurationMs = run.FinishedAt.Sub(run.StartedAt).Nanoseconds() / int64(time.Millisecond)
+	return &InsertRecord{
+		Collector: run.Collector,
+		TableName: RunHistoryTableName,
+		FieldNames: []string{"session_id", "run_id", "collector", "status", "reason", "stderr",
+			"started_at", "finished_at", "duration_ms"},
+		Values: []interface{}{run.SessionID, run.RunID, run.Collector, run.Status, run.Reason, run.Stderr,
+			run.StartedAt, run.FinishedAt, run.DurationMs},
+	}
+}
+
+// CreateTable creates or migrates the table of a collection, it returns the name of the
+// table the rows have to be stored on, which changes with incompatible schema versions.
+// It is the only write not done by the database writer: it runs on the collector once per
+// table and session, as the rows can only be queued once their table is known.
+func (db *DBStorage) CreateTable(tableName string, fields []MapValueField, indexes []IndexConfig) (string, error) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	if table, ok := db.Tables[tableName]; ok {
+		log.Tracef("Table %s already exists, skipping", tableName)
+		return table, nil
+	}
 	log.Debugf("Creating table: %s on database", tableName)
-	if _, ok := db.Tables[tableName]; ok {
-		log.Debugf("Table %s already exists, skipping", tableName)
-		return
+
+	schema, changed, err := db.ResolveSchema(tableName, fields)
+	if err != nil {
+		return "", err
 	}
 
-	instance := dynamicstruct.ExtendStruct(gorm.Model{})
+	// the columns of gorm.Model, without the deleted_at index gorm cannot create either.
+	instance := dynamicstruct.NewStruct()
+	instance.AddField("ID", uint(0), `gorm:"primary_key"`)
+	instance.AddField("CreatedAt", time.Time{}, "")
+	instance.AddField("UpdatedAt", time.Time{}, "")
+	instance.AddField("DeletedAt", (*time.Time)(nil), "")
+	instance.AddField("SessionID", uint(0), "")
+	instance.AddField("RunID", "", "")
 
 	for _, field := range fields {
-		if field.Type == "float" {
+		if field.Timestamp {
+			instance.AddField(Capitalize(field.Name), "", "")
+		} else if field.Type == "float" {
 			instance.AddField(Capitalize(field.Name), 0.0, "")
 		} else if field.Type == "int" {
 			instance.AddField(Capitalize(field.Name), 0, "")
@@ -44,26 +182,158 @@ func (db *DBStorage) CreateTable(tableName string, fields []MapValueField) {
 
 	newInst := instance.Build().New()
 
-	table := db.Table(tableName)
+	table := db.Table(schema.Table)
 	if table.HasTable(newInst) {
-		table.AutoMigrate(newInst)
+		err = table.AutoMigrate(newInst).Error
 	} else {
-		table.CreateTable(newInst)
+		err = table.CreateTable(newInst).Error
+	}
+	if err != nil {
+		return "", err
 	}
 
-	db.Tables[tableName] = true
+	// gorm cannot create the indexes of a struct stored on a named table, so rows are
+	// indexed by run and timestamp fields here along with the configured indexes.
+	builtin := []IndexConfig{{Columns: []string{"run_id"}}}
+	for _, field := range fields {
+		if field.Timestamp {
+			builtin = append(builtin, IndexConfig{Columns: []string{field.Name}})
+		}
+	}
+	indexes = append(builtin, indexes...)
+	for _, index := range indexes {
+		var columns []string
+		for _, column := range index.Columns {
+			columns = append(columns, QuoteIdentifier(column))
+		}
+		statement := "CREATE INDEX"
+		if index.Unique {
+			statement = "CREATE UNIQUE INDEX"
+		}
+		if err := db.Exec(fmt.Sprintf("%s IF NOT EXISTS %s ON %s (%s)", statement, QuoteIdentifier(index.Name(schema.Table)),
+			QuoteIdentifier(schema.Table), strings.Join(columns, ", "))).Error; err != nil {
+			return "", fmt.Errorf("cannot create index %s: %s", index.Name(schema.Table), err)
+		}
+	}
+
+	if changed {
+		schema.SessionID = db.SessionID
+		if err := db.Create(schema).Error; err != nil {
+			return "", err
+		}
+	}
+
+	if schema.Table != tableName {
+		if err := db.ResolveDictionaryTable(tableName, schema.Table); err != nil {
+			return "", err
+		}
+	}
+
+	db.Tables[tableName] = schema.Table
+	return schema.Table, nil
+}
+
+// CreateViews creates or replaces the configured views, a failing view is reported
+// without preventing the creation of the rest.
+func (db *DBStorage) CreateViews(views []ViewConfig) {
+	for _, view := range views {
+		err := db.Exec("DROP VIEW IF EXISTS " + QuoteIdentifier(view.Name)).Error
+		if err == nil {
+			err = db.Exec(fmt.Sprintf("CREATE VIEW %s AS %s", QuoteIdentifier(view.Name), view.SQL)).Error
+		}
+		if err != nil {
+			log.Errorf("Cannot create view %s: %s", view.Name, err)
+			continue
+		}
+		log.Infof("Created database view: %s", view.Name)
+	}
+}
+
+// QuoteIdentifier quotes a table or column name to be used on a sqlite statement.
+func QuoteIdentifier(name string) string {
+	return `"` + strings.Replace(name, `"`, `""`, -1) + `"`
+}
+
+// InsertBatch inserts the records of a single table, see InsertBatches.
+func (db *DBStorage) InsertBatch(tableName string, records []*InsertRecord) (int, error) {
+	return db.InsertBatches(map[string][]*InsertRecord{tableName: records})
+}
+
+// InsertBatches inserts the records of several tables within a single transaction, using a
+// prepared statement per table. A failing row is reported and skipped without discarding the
+// rest of the batch. It returns the number of inserted rows.
+func (db *DBStorage) InsertBatches(batches map[string][]*InsertRecord) (int, error) {
+	tx, err := db.DB.DB().Begin()
+	if err != nil {
+		return 0, err
+	}
+
+	var tableErr error
+	inserted := 0
+	for tableName, records := range batches {
+		if len(records) == 0 {
+			continue
+		}
+
+		var columns []string
+		for _, name := range records[0].FieldNames {
+			columns = append(columns, QuoteIdentifier(name))
+		}
+		query := fmt.Sprintf("INSERT INTO main.%s (%s) VALUES (%s)", QuoteIdentifier(tableName),
+			strings.Join(columns, ", "), strings.TrimSuffix(strings.Repeat("?, ", len(columns)), ", "))
+
+		stmt, err := tx.Prepare(query)
+		if err != nil {
+			log.Errorf("Cannot insert %d rows into table %s: %s", len(records), tableName, err)
+			if tableErr == nil {
+				tableErr = err
+			}
+			continue
+		}
+
+		tableInserted := 0
+		for i, record := range records {
+			if _, err := stmt.Exec(record.Values...); err != nil {
+				log.Errorf("Cannot insert row %d of %d into table %s, values: %v: %s", i+1, len(records), tableName, record.Values, err)
+				continue
+			}
+			tableInserted++
+		}
+		stmt.Close()
+		inserted += tableInserted
+		log.Tracef("Executed query: %s (%d rows)", query, tableInserted)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return inserted, tableErr
 }
 
 type InsertRecord struct {
+	Collector  string
 	TableName  string
 	FieldNames []string
-	Values     []string
+	Values     []interface{}
+	// dropped is called if the queue policy drops the record once queued.
+	dropped func()
 }
 
-func (db *DBStorage) CreateRecord(task *SchedulerTask, tableName string, fields []MapValueField, values []string) error {
+// RowContext identifies the run that produced a row and the time it was collected at.
+type RowContext struct {
+	RunID       string
+	CollectedAt time.Time
+}
+
+// CreateRecord maps the values of an output line into a row of the given table, and queues
+// it to be inserted into tableName, unless the table stores only changes and the values of
+// the row did not change.
+func (db *DBStorage) CreateRecord(task *SchedulerTask, target *TaskTable, tableName string, values []string, row RowContext) error {
+	fields := target.MapValues.Fields
 
 	var insertIntoDB = func(table string, fields []MapValueField, values []string) error {
-		var fieldNames, formattedValues []string
+		var fieldNames []string
+		var fieldValues []interface{}
 
 		if table == "" || fields == nil || values == nil {
 			return fmt.Errorf("Skipping data insertion, nil values passed to insertIntoDb")
@@ -71,25 +341,64 @@ func (db *DBStorage) CreateRecord(task *SchedulerTask, tableName string, fields
 
 		log.Debugf("creating new record entry on table: %s", table)
 
-		fieldNames = append(fieldNames, "created_at")
+		fieldNames = append(fieldNames, "created_at", "session_id", "run_id")
 		for _, field := range fields {
 			fieldNames = append(fieldNames, field.Name)
 		}
 
-		formattedValues = append(formattedValues, "datetime('now')")
+		collectedAt := row.CollectedAt
+		if collectedAt.IsZero() {
+			collectedAt = time.Now()
+		}
+		// a timestamp field overrides the collection time of the row.
+		rowTime := collectedAt
+		fieldValues = append(fieldValues, nil, db.SessionID, row.RunID)
 		for _, field := range fields {
-			formattedValues = append(formattedValues, field.Format(values))
+			if !field.Timestamp {
+				fieldValues = append(fieldValues, field.Value(values))
+				continue
+			}
+			at, err := field.Time(values, collectedAt)
+			if err != nil {
+				log.Debugf("Collector %s, using the collection time: %s", task.Name, err)
+				fieldValues = append(fieldValues, nil)
+				continue
+			}
+			rowTime = at
+			fieldValues = append(fieldValues, at.UTC().Format(SQLiteDateTimeFormat))
 		}
+		fieldValues[0] = rowTime.UTC().Format(SQLiteDateTimeFormat)
 
-		if !task.Scheduler.Stopped {
-			*task.DBOpsQueue <- &InsertRecord{FieldNames: fieldNames, Values: formattedValues, TableName: table}
+		if target.Changes != nil && !target.Changes.Changed(fields, fieldValues[3:], rowTime) {
+			log.Tracef("Collector %s, skipping unchanged row on table: %s", task.Name, table)
+			task.Stats.AddUnchanged()
+			return nil
+		}
+
+		record := &InsertRecord{Collector: task.Name, FieldNames: fieldNames, Values: fieldValues, TableName: table}
+		if target.Changes == nil {
+			task.Enqueue(record)
+			return nil
+		}
+		// the row is only remembered as stored while it is on its way to the database, it is
+		// forgotten again if the queue policy drops it, even before it is remembered.
+		var dropped int32
+		record.dropped = func() {
+			atomic.StoreInt32(&dropped, 1)
+			target.Changes.Forget(fields, fieldValues[3:], rowTime)
+		}
+		if task.Enqueue(record) {
+			target.Changes.Store(fields, fieldValues[3:], rowTime)
+			if atomic.LoadInt32(&dropped) == 1 {
+				target.Changes.Forget(fields, fieldValues[3:], rowTime)
+			}
 		}
 		return nil
 	}
 
 	var isIndexOnValues = func(values []string) error {
 		for _, field := range fields {
-			if field.Index > len(values) {
+			if field.Index >= len(values) {
 				return fmt.Errorf(
 					"Not found value that matches field: %s with idx: %d in returned values (length: %d)",
 					field.Name, field.Index, len(values))
@@ -0,0 +1,543 @@
+package main
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestInsertBatchBindsValues(t *testing.T) {
+	dir, err := ioutil.TempDir("", DEFAULT_REPORT_PREFIX)
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	db, err := NewDBStorage(dir)
+	assert.Nil(t, err)
+	defer db.Close()
+
+	fields := []MapValueField{{Name: "command", Index: 0, Type: "string"}, {Name: "rss", Index: 1, Type: "int"}}
+	table, err := db.CreateTable("processes", fields, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "processes", table)
+
+	records := []*InsertRecord{
+		{FieldNames: []string{"command", "rss"}, Values: []interface{}{"it's", int64(1)}},
+		{FieldNames: []string{"command", "rss"}, Values: []interface{}{"short"}},
+		{FieldNames: []string{"command", "rss"}, Values: []interface{}{"x'); DROP TABLE processes; --", int64(2)}},
+		{FieldNames: []string{"command", "missing"}, Values: []interface{}{"bad", int64(3)}},
+	}
+	inserted, err := db.InsertBatch("processes", records[:3])
+	assert.Nil(t, err)
+	assert.Equal(t, 2, inserted)
+
+	_, err = db.InsertBatch("processes", records[3:])
+	assert.Error(t, err)
+
+	var commands []string
+	assert.Nil(t, db.Table("processes").Order("rss").Pluck("command", &commands).Error)
+	assert.Equal(t, []string{"it's", "x'); DROP TABLE processes; --"}, commands)
+}
+
+func TestMapValueFieldValue(t *testing.T) {
+	values := []string{"bash", "12", "0.5", "n/a"}
+	assert.Equal(t, "bash", (&MapValueField{Index: 0, Type: "string"}).Value(values))
+	assert.Equal(t, int64(12), (&MapValueField{Index: 1, Type: "int"}).Value(values))
+	assert.Equal(t, 0.5, (&MapValueField{Index: 2, Type: "float"}).Value(values))
+	assert.Equal(t, int64(0), (&MapValueField{Index: 3, Type: "int"}).Value(values))
+	assert.Equal(t, "", (&MapValueField{Index: 9, Type: "string"}).Value(values))
+}
+
+func TestCreateTableVersionsSchema(t *testing.T) {
+	dir, err := ioutil.TempDir("", DEFAULT_REPORT_PREFIX)
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	var createTable = func(fields ...MapValueField) string {
+		db, err := NewDBStorage(dir)
+		assert.Nil(t, err)
+		defer db.Close()
+		table, err := db.CreateTable("load", fields, nil)
+		assert.Nil(t, err)
+		return table
+	}
+
+	load := MapValueField{Name: "load", Index: 0, Type: "float"}
+	assert.Equal(t, "load", createTable(load))
+	assert.Equal(t, "load", createTable(MapValueField{Name: "load", Index: 1, Type: "float"}))
+	assert.Equal(t, "load", createTable(load, MapValueField{Name: "procs", Index: 1, Type: "int"}))
+	assert.Equal(t, "load_v3", createTable(MapValueField{Name: "load", Index: 0, Type: "string"}))
+
+	db, err := NewDBStorage(dir)
+	assert.Nil(t, err)
+	defer db.Close()
+	var versions []int
+	assert.Nil(t, db.Model(&TableSchema{}).Where("name = ?", "load").Order("version").Pluck("version", &versions).Error)
+	assert.Equal(t, []int{1, 2, 3}, versions)
+	assert.True(t, db.HasTable("load_v3"))
+}
+
+func TestMapValueFieldTime(t *testing.T) {
+	collectedAt := time.Date(2020, 5, 6, 10, 0, 0, 0, time.UTC)
+	for layout, value := range map[string]string{
+		"":                     "2020-05-06T07:08:09Z",
+		"15:04:05":             "07:08:09",
+		"Jan _2 15:04:05 2006": "May  6 07:08:09 2020",
+		"Jan _2 15:04:05":      "May  6 07:08:09",
+		TimestampEpoch:         "1588748889",
+		TimestampEpochMs:       "1588748889000",
+	} {
+		field := MapValueField{Name: "time", Timestamp: true, Layout: layout}
+		at, err := field.Time([]string{value}, collectedAt)
+		assert.Nil(t, err, layout)
+		assert.True(t, at.Equal(time.Date(2020, 5, 6, 7, 8, 9, 0, time.UTC)), "%s: %s", layout, at)
+	}
+
+	// lines of the end of the previous year read at the start of the next one.
+	syslog := MapValueField{Name: "time", Timestamp: true, Layout: "Jan _2 15:04:05"}
+	at, err := syslog.Time([]string{"Dec 31 23:59:00"}, time.Date(2021, 1, 1, 0, 5, 0, 0, time.UTC))
+	assert.Nil(t, err)
+	assert.Equal(t, time.Date(2020, 12, 31, 23, 59, 0, 0, time.UTC), at)
+
+	_, err = (&MapValueField{Name: "time", Timestamp: true, Layout: TimestampEpoch}).Time([]string{"now"}, collectedAt)
+	assert.Error(t, err)
+}
+
+func TestCreateRecordUsesTimestampField(t *testing.T) {
+	queue := make(chan *InsertRecord, 2)
+	task := &SchedulerTask{Name: "log", DBOpsQueue: &queue}
+	table := &TaskTable{Name: "log", MapValues: MapValue{Fields: []MapValueField{
+		{Name: "time", Index: 0, Timestamp: true, Layout: TimestampEpochMs}, {Name: "message", Index: 1, Type: "string"}}}}
+	collectedAt := time.Date(2020, 5, 6, 10, 0, 0, 0, time.UTC)
+	db := &DBStorage{}
+
+	assert.Nil(t, db.CreateRecord(task, table, "log", []string{"1588748889123", "started"}, RowContext{CollectedAt: collectedAt}))
+	assert.Nil(t, db.CreateRecord(task, table, "log", []string{"garbage", "started"}, RowContext{CollectedAt: collectedAt}))
+
+	record := <-queue
+	assert.Equal(t, "2020-05-06 07:08:09.123", record.Values[0])
+	assert.Equal(t, "2020-05-06 07:08:09.123", record.Values[3])
+	record = <-queue
+	assert.Equal(t, "2020-05-06 10:00:00.000", record.Values[0])
+	assert.Nil(t, record.Values[3])
+}
+
+func TestCreateTableIndexesTimestampField(t *testing.T) {
+	dir, err := ioutil.TempDir("", DEFAULT_REPORT_PREFIX)
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	db, err := NewDBStorage(dir)
+	require.Nil(t, err)
+	defer db.Close()
+
+	_, err = db.CreateTable("log", []MapValueField{{Name: "time", Index: 0, Timestamp: true, Layout: TimestampEpochMs},
+		{Name: "message", Index: 1, Type: "string"}}, nil)
+	require.Nil(t, err)
+
+	var indexes int
+	require.Nil(t, db.DB.DB().QueryRow("SELECT count(*) FROM sqlite_master WHERE type = 'index' AND tbl_name = 'log' AND name = 'idx_log_time'").Scan(&indexes))
+	assert.Equal(t, 1, indexes)
+}
+
+func TestDBStorageUsesWAL(t *testing.T) {
+	dir, err := ioutil.TempDir("", DEFAULT_REPORT_PREFIX)
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	db, err := NewDBStorage(dir)
+	assert.Nil(t, err)
+
+	var mode string
+	assert.Nil(t, db.DB.DB().QueryRow("PRAGMA journal_mode").Scan(&mode))
+	assert.Equal(t, "wal", mode)
+
+	assert.Nil(t, db.Checkpoint())
+	assert.Nil(t, db.Close())
+	assert.NoFileExists(t, filepath.Join(dir, DBFileName+"-wal"))
+}
+
+// BenchmarkPsAuxCollection stores the output of ps aux as a 1s-interval process_list
+// collection would, every iteration being one tick collected a second after the previous
+// one. The time per op is the latency of storing a tick (mapping its rows and inserting
+// them on a transaction, as the writer does), which has to stay well below the interval.
+func BenchmarkPsAuxCollection(b *testing.B) {
+	dir, err := ioutil.TempDir("", DEFAULT_REPORT_PREFIX)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDBStorage(dir)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer db.Close()
+
+	output, err := exec.Command("ps", "aux", "--no-headers").Output()
+	if err != nil {
+		b.Skipf("cannot run ps aux: %s", err)
+	}
+
+	queue := make(chan *InsertRecord, 100000)
+	scheduler := &Scheduler{DBStorage: db, DBOpsQueue: &queue, Tasks: make(map[string]*SchedulerTask)}
+	task := &SchedulerTask{Name: "process_list", DBStorage: db, DBOpsQueue: &queue, Scheduler: scheduler}
+	task.Config.BatchSize = 1000
+	task.Config.Database.MapValues = MapValue{Separator: " ", Fields: []MapValueField{
+		{Name: "pid", Index: 1, Type: "string"}, {Name: "vsz", Index: 4, Type: "int"}, {Name: "rss", Index: 5, Type: "int"},
+	}}
+	scheduler.Tasks[task.Name] = task
+
+	// the rows of every tick of a 1s collection go through the single writer, the benchmark
+	// ends once the writer inserted all of them.
+	inserted := make(chan struct{})
+	collectedAt := time.Now()
+	b.ResetTimer()
+	started := time.Now()
+	go func() {
+		scheduler.WaitForRecordsToInsert(&queue)
+		close(inserted)
+	}()
+	for i := 0; i < b.N; i++ {
+		if err := task.StoreResultsToDB(&RunResult{Output: output, StartedAt: collectedAt}); err != nil {
+			b.Fatal(err)
+		}
+		collectedAt = collectedAt.Add(time.Second)
+	}
+	close(queue)
+	<-inserted
+	elapsed := time.Since(started)
+	b.StopTimer()
+
+	var rows int
+	db.Table(task.TableName()).Count(&rows)
+	b.ReportMetric(float64(rows)/elapsed.Seconds(), "rows/s")
+	b.ReportMetric(float64(rows)/float64(b.N), "rows/tick")
+}
+
+func TestStoreResultsIntoMultipleTables(t *testing.T) {
+	dir, err := ioutil.TempDir("", DEFAULT_REPORT_PREFIX)
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	db, err := NewDBStorage(dir)
+	assert.Nil(t, err)
+	defer db.Close()
+
+	config := DBConfig{Tables: []TableConfig{
+		{Name: "TCP_Sockets", Match: "^TCP:", MapValues: MapValue{Separator: " ", Fields: []MapValueField{
+			{Name: "inuse", Index: 2, Type: "int"}, {Name: "alloc", Index: 8, Type: "int"}}}},
+		{Name: "udp_sockets", Match: "^UDP", MapValues: MapValue{Separator: " ", Fields: []MapValueField{
+			{Name: "inuse", Index: 2, Type: "int"}}}},
+	}}
+	assert.Nil(t, config.SetDefaults())
+
+	queue := make(chan *InsertRecord, 10)
+	task := &SchedulerTask{Name: "sockstat", DBStorage: db, DBOpsQueue: &queue}
+	task.Tables, err = NewTaskTables(task.TableName(), config)
+	assert.Nil(t, err)
+
+	output := "sockets: used 18\nTCP: inuse 4 orphan 0 tw 0 alloc 5 mem 0\nUDP: inuse 1 mem 0\nUDPLITE: inuse 2\n"
+	assert.Nil(t, task.StoreResultsToDB(&RunResult{Output: []byte(output)}))
+	close(queue)
+
+	tables := make(map[string][]int64)
+	for record := range queue {
+		tables[record.TableName] = append(tables[record.TableName], record.Values[3].(int64))
+	}
+	assert.Equal(t, map[string][]int64{"tcp_sockets": {4}, "udp_sockets": {1, 2}}, tables)
+	assert.False(t, db.HasTable("sockstat"))
+}
+
+func TestCustomTableIndexesAndViews(t *testing.T) {
+	dir, err := ioutil.TempDir("", DEFAULT_REPORT_PREFIX)
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	db, err := NewDBStorage(dir)
+	assert.Nil(t, err)
+	defer db.Close()
+
+	queue := make(chan *InsertRecord, 10)
+	task := &SchedulerTask{Name: "Process_List", DBStorage: db, DBOpsQueue: &queue}
+	task.Config.Database = DBConfig{Name: "processes", Indexes: []IndexConfig{{Columns: []string{"pid", "created_at"}}},
+		MapValues: MapValue{Separator: " ", Fields: []MapValueField{{Name: "pid", Index: 0, Type: "int"}, {Name: "rss", Index: 1, Type: "int"}}}}
+	assert.Nil(t, task.Config.Database.SetDefaults())
+	assert.Equal(t, "processes", task.TableName())
+
+	assert.Nil(t, task.StoreResultsToDB(&RunResult{Output: []byte("1 100\n2 300\n")}))
+	close(queue)
+	var records []*InsertRecord
+	for record := range queue {
+		records = append(records, record)
+	}
+	_, err = db.InsertBatch("processes", records)
+	assert.Nil(t, err)
+
+	var indexes int
+	db.DB.DB().QueryRow("SELECT count(*) FROM sqlite_master WHERE type = 'index' AND name = 'idx_processes_pid_created_at'").Scan(&indexes)
+	assert.Equal(t, 1, indexes)
+	db.DB.DB().QueryRow("SELECT count(*) FROM sqlite_master WHERE type = 'index' AND name = 'idx_processes_run_id'").Scan(&indexes)
+	assert.Equal(t, 1, indexes)
+
+	db.CreateViews([]ViewConfig{
+		{Name: "max_rss", SQL: "SELECT max(rss) AS rss FROM processes"},
+		{Name: "broken", SQL: "SELECT FROM"},
+	})
+	var rss int
+	assert.Nil(t, db.DB.DB().QueryRow("SELECT rss FROM max_rss").Scan(&rss))
+	assert.Equal(t, 300, rss)
+	var broken int
+	db.DB.DB().QueryRow("SELECT count(*) FROM sqlite_master WHERE name = 'broken'").Scan(&broken)
+	assert.Equal(t, 0, broken)
+}
+
+func TestCreateRecordStoresOnChange(t *testing.T) {
+	queue := make(chan *InsertRecord, 10)
+	task := &SchedulerTask{Name: "mtu", DBOpsQueue: &queue}
+	config := DBConfig{Changes: ChangeConfig{StoreOnChange: true, Key: []string{"interface"}, KeyframeInterval: "2m"},
+		MapValues: MapValue{Separator: " ", Fields: []MapValueField{{Name: "interface", Index: 0}, {Name: "mtu", Index: 1, Type: "int"}}}}
+	assert.Nil(t, config.SetDefaults())
+	tables, err := NewTaskTables("mtu", config)
+	assert.Nil(t, err)
+
+	start := time.Date(2020, 5, 6, 10, 0, 0, 0, time.UTC)
+	for i, line := range []string{"eth0 1500", "lo 65536", "eth0 1500", "lo 65536", "eth0 9000", "eth0 9000", "eth0 9000", "lo 65536"} {
+		at := start.Add(time.Duration(i) * 30 * time.Second)
+		assert.Nil(t, (&DBStorage{}).CreateRecord(task, tables[0], "mtu", strings.Split(line, " "), RowContext{CollectedAt: at}))
+	}
+	close(queue)
+
+	var stored []string
+	for record := range queue {
+		stored = append(stored, fmt.Sprintf("%s %v %v", record.Values[0], record.Values[3], record.Values[4]))
+	}
+	assert.Equal(t, []string{
+		"2020-05-06 10:00:00.000 eth0 1500",
+		"2020-05-06 10:00:30.000 lo 65536",
+		"2020-05-06 10:02:00.000 eth0 9000",
+		"2020-05-06 10:03:30.000 lo 65536",
+	}, stored)
+	assert.Equal(t, 4, task.Stats.UnchangedRows)
+}
+
+func TestCreateRecordStoresOnChangeAfterDrop(t *testing.T) {
+	config := DBConfig{Changes: ChangeConfig{StoreOnChange: true, Key: []string{"interface"}, KeyframeInterval: "1h"},
+		MapValues: MapValue{Separator: " ", Fields: []MapValueField{{Name: "interface", Index: 0}, {Name: "mtu", Index: 1, Type: "int"}}}}
+	require.Nil(t, config.SetDefaults())
+	start := time.Date(2020, 5, 6, 10, 0, 0, 0, time.UTC)
+
+	for _, policy := range []string{QueueDropNewest, QueueDropOldest} {
+		tables, err := NewTaskTables("mtu", config)
+		require.Nil(t, err)
+		task, queue := newQueueTask(1, policy)
+		store := func(at time.Duration) {
+			assert.Nil(t, (&DBStorage{}).CreateRecord(task, tables[0], "mtu", []string{"eth0", "1500"}, RowContext{CollectedAt: start.Add(at)}))
+		}
+
+		if policy == QueueDropNewest {
+			// the row does not fit on the full queue.
+			queue <- &InsertRecord{Collector: task.Name}
+			store(0)
+		} else {
+			// the queued row makes room for a later record.
+			store(0)
+			task.Enqueue(&InsertRecord{Collector: task.Name})
+		}
+		assert.Equal(t, 1, task.Stats.DroppedRows, policy)
+		<-queue
+
+		store(30 * time.Second)
+		require.Len(t, queue, 1, policy)
+		assert.Equal(t, "2020-05-06 10:00:30.000", (<-queue).Values[0], policy)
+	}
+}
+
+func TestRollupTableAndRetention(t *testing.T) {
+	dir, err := ioutil.TempDir("", DEFAULT_REPORT_PREFIX)
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	db, err := NewDBStorage(dir)
+	assert.Nil(t, err)
+	defer db.Close()
+
+	fields := []MapValueField{{Name: "command", Index: 0}, {Name: "rss", Index: 1, Type: "int"}}
+	table, err := db.CreateTable("processes", fields, nil)
+	assert.Nil(t, err)
+	tables, err := NewTaskTables("processes", DBConfig{MapValues: MapValue{Fields: fields}})
+	assert.Nil(t, err)
+	rollups, err := NewRollups(tables, DBConfig{Rollup: []RollupConfig{{Interval: "1m", Key: []string{"command"}, Fields: []string{"rss"}}}}, 10*time.Second)
+	assert.Nil(t, err)
+	require.Len(t, rollups, 1)
+	assert.Equal(t, "processes_rollup_1m", rollups[0].Name)
+
+	start := time.Date(2020, 5, 6, 10, 0, 0, 0, time.UTC)
+	insert := func(offsets ...time.Duration) {
+		var records []*InsertRecord
+		for i, offset := range offsets {
+			records = append(records, &InsertRecord{FieldNames: []string{"created_at", "command", "rss"},
+				Values: []interface{}{start.Add(offset).Format(SQLiteDateTimeFormat), "bash", 100 * (i + 1)}})
+		}
+		_, err := db.InsertBatch(table, records)
+		assert.Nil(t, err)
+	}
+	// two rows on the first minute, one on the second and one on the third.
+	insert(10*time.Second, 50*time.Second, 70*time.Second, 130*time.Second)
+
+	// the third minute ended less than the lag ago, so it is not rolled up yet.
+	assert.Equal(t, start.Add(2*time.Minute), rollups[0].Cutoff(start.Add(3*time.Minute)))
+	rows, err := db.RollupTable(rollups[0], table, rollups[0].Cutoff(start.Add(3*time.Minute)))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2), rows)
+
+	rows, err = db.RollupTable(rollups[0], table, rollups[0].Cutoff(start.Add(3*time.Minute)))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), rows)
+
+	// rolled up minutes are final, a row arriving later than the lag is not counted.
+	insert(80 * time.Second)
+	rows, err = db.RollupTable(rollups[0], table, start.Add(4*time.Minute))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), rows)
+
+	type bucket struct {
+		Bucket        string
+		Samples       int
+		Min, Max, Avg float64
+	}
+	var buckets []bucket
+	query, err := db.DB.DB().Query("SELECT bucket, samples, rss_min, rss_max, rss_avg FROM processes_rollup_1m ORDER BY bucket")
+	assert.Nil(t, err)
+	for query.Next() {
+		var b bucket
+		assert.Nil(t, query.Scan(&b.Bucket, &b.Samples, &b.Min, &b.Max, &b.Avg))
+		buckets = append(buckets, b)
+	}
+	query.Close()
+	assert.Equal(t, []bucket{
+		{"2020-05-06 10:00:00.000", 2, 100, 200, 150},
+		{"2020-05-06 10:01:00.000", 1, 300, 300, 300},
+		{"2020-05-06 10:02:00.000", 1, 400, 400, 400},
+	}, buckets)
+
+	deleted, err := db.DeleteOlderThan(table, start.Add(time.Minute))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2), deleted)
+}
+
+func TestRollupIntervalNotDividingADay(t *testing.T) {
+	dir, err := ioutil.TempDir("", DEFAULT_REPORT_PREFIX)
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	db, err := NewDBStorage(dir)
+	require.Nil(t, err)
+	defer db.Close()
+
+	fields := []MapValueField{{Name: "value", Index: 0, Type: "int"}}
+	table, err := db.CreateTable("samples", fields, nil)
+	require.Nil(t, err)
+	tables, err := NewTaskTables("samples", DBConfig{MapValues: MapValue{Fields: fields}})
+	require.Nil(t, err)
+	rollups, err := NewRollups(tables, DBConfig{Rollup: []RollupConfig{{Interval: "7m", Fields: []string{"value"}}}}, 10*time.Second)
+	require.Nil(t, err)
+
+	// a row every minute, rolled up every minute, for two hours.
+	start := time.Date(2020, 5, 6, 10, 0, 0, 0, time.UTC)
+	for minute := 0; minute < 120; minute++ {
+		now := start.Add(time.Duration(minute) * time.Minute)
+		_, err := db.InsertBatch(table, []*InsertRecord{{FieldNames: []string{"created_at", "value"},
+			Values: []interface{}{now.Format(SQLiteDateTimeFormat), minute}}})
+		require.Nil(t, err)
+		_, err = db.RollupTable(rollups[0], table, rollups[0].Cutoff(now.Add(time.Minute)))
+		require.Nil(t, err)
+	}
+
+	var samples []int
+	require.Nil(t, db.Raw("SELECT samples FROM samples_rollup_7m ORDER BY bucket").Pluck("samples", &samples).Error)
+	require.True(t, len(samples) > 10)
+	// the first bucket started before the first row.
+	for _, count := range samples[1:] {
+		assert.Equal(t, 7, count)
+	}
+}
+
+func TestWriteDataDictionary(t *testing.T) {
+	dir, err := ioutil.TempDir("", DEFAULT_REPORT_PREFIX)
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	db, err := NewDBStorage(dir)
+	assert.Nil(t, err)
+	defer db.Close()
+	assert.Nil(t, db.StartSession("repeat.yaml"))
+
+	scheduler := &Scheduler{DBStorage: db, Tasks: map[string]*SchedulerTask{
+		"uptime": {Name: "uptime", Command: "cat /proc/uptime", RunEvery: time.Second,
+			Config: Collection{Store: "file", Mode: ModeRun, Description: "seconds since boot"}},
+		"meminfo": {Name: "meminfo", Command: "free -k", RunEvery: 5 * time.Second,
+			Config: Collection{Store: "database", Mode: ModeRun, Description: "system memory", Database: DBConfig{
+				MapValues: MapValue{Fields: []MapValueField{{Name: "mem", Index: 1, Type: "int", Unit: "KiB", Description: "total memory"}}}}}},
+	}}
+	assert.Nil(t, scheduler.DescribeCollections())
+
+	var collections []CollectionInfo
+	assert.Nil(t, db.Order("name").Find(&collections).Error)
+	assert.Len(t, collections, 2)
+	assert.Equal(t, "free -k", collections[0].Command)
+	assert.Equal(t, "system memory", collections[0].Description)
+	assert.Equal(t, "meminfo", collections[0].Tables)
+	assert.Equal(t, "", collections[1].Tables)
+	assert.Equal(t, db.SessionID, collections[1].SessionID)
+
+	var column ColumnInfo
+	assert.Nil(t, db.Where("collection = ? AND \"column\" = ?", "meminfo", "mem").First(&column).Error)
+	assert.Equal(t, "KiB", column.Unit)
+	assert.Equal(t, "total memory", column.Description)
+	var columns int
+	assert.Nil(t, db.Model(&ColumnInfo{}).Where("\"table\" = ?", "meminfo").Count(&columns).Error)
+	assert.Equal(t, 4, columns)
+}
+
+func TestDataDictionaryRecordsVersionedTable(t *testing.T) {
+	dir, err := ioutil.TempDir("", DEFAULT_REPORT_PREFIX)
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	db, err := NewDBStorage(dir)
+	require.Nil(t, err)
+	defer db.Close()
+
+	_, err = db.CreateTable("meminfo", []MapValueField{{Name: "mem", Index: 1, Type: "int"}}, nil)
+	require.Nil(t, err)
+
+	// a new session retypes the field, so its rows are stored on a versioned table.
+	db.Tables = make(map[string]string)
+	require.Nil(t, db.StartSession("repeat.yaml"))
+	fields := []MapValueField{{Name: "mem", Index: 1, Type: "string", Unit: "KiB"}}
+	scheduler := &Scheduler{DBStorage: db, Tasks: map[string]*SchedulerTask{
+		"meminfo": {Name: "meminfo", Command: "free -k", Config: Collection{Store: "database", Mode: ModeRun,
+			Database: DBConfig{MapValues: MapValue{Fields: fields}}}},
+	}}
+	require.Nil(t, scheduler.DescribeCollections())
+	table, err := db.CreateTable("meminfo", fields, nil)
+	require.Nil(t, err)
+	assert.Equal(t, "meminfo_v2", table)
+
+	var collection CollectionInfo
+	require.Nil(t, db.Where("session_id = ?", db.SessionID).First(&collection).Error)
+	assert.Equal(t, "meminfo_v2", collection.Tables)
+	var columns []ColumnInfo
+	require.Nil(t, db.Where("session_id = ?", db.SessionID).Find(&columns).Error)
+	require.Len(t, columns, 4)
+	for _, column := range columns {
+		assert.Equal(t, "meminfo_v2", column.Table)
+	}
+}
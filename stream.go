@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+const StreamStderrSuffix = "-stream.stderr"
+
+// MaxStreamLineSize is the longest line accepted from a streaming command.
+const MaxStreamLineSize = 1024 * 1024
+
+// RotatingFile writes timestamped lines into result files, switching to a new
+// file once the current one reaches MaxSize bytes.
+type RotatingFile struct {
+	BaseDir, Name string
+	MaxSize       int64
+	file          *os.File
+	size          int64
+}
+
+func NewRotatingFile(baseDir, name string, maxSize int64) *RotatingFile {
+	return &RotatingFile{BaseDir: baseDir, Name: name, MaxSize: maxSize}
+}
+
+func (rf *RotatingFile) rotate() error {
+	if err := rf.Close(); err != nil {
+		return err
+	}
+	fileName := filepath.Join(rf.BaseDir, fmt.Sprintf("%s-%s", rf.Name, time.Now().Format("2006-01-02-15:04:05")))
+	file, err := os.OpenFile(fileName, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0750)
+	if err != nil {
+		return err
+	}
+	stat, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	log.Debugf("Collector %s, streaming results into file: %s", rf.Name, fileName)
+	rf.file, rf.size = file, stat.Size()
+	return nil
+}
+
+func (rf *RotatingFile) WriteLine(at time.Time, line string) error {
+	if rf.file == nil || (rf.MaxSize > 0 && rf.size >= rf.MaxSize) {
+		if err := rf.rotate(); err != nil {
+			return err
+		}
+	}
+	written, err := fmt.Fprintf(rf.file, "%s %s\n", at.Format(time.RFC3339Nano), line)
+	rf.size += int64(written)
+	return err
+}
+
+func (rf *RotatingFile) Close() error {
+	if rf.file == nil {
+		return nil
+	}
+	err := rf.file.Close()
+	rf.file = nil
+	return err
+}
+
+// RunStream starts the task command and processes its output line by line as it is
+// produced, the command is restarted after the restart-delay whenever it exits.
+func (scheduler *Scheduler) RunStream(task *SchedulerTask) {
+	var output *RotatingFile
+	if task.Config.Store == "file" {
+		output = NewRotatingFile(task.BaseDir, task.Name, task.RotateSize)
+		defer output.Close()
+	}
+
+	for !scheduler.IsStopping() {
+		run := &RunHistory{RunID: scheduler.NewRunID(task), Collector: task.Name, StartedAt: time.Now(), Status: RunStatusSuccess}
+		if err := task.Stream(output, run.RunID); err != nil && !task.IsValidExitCode(err) {
+			run.Status, run.Reason = RunStatusFailed, err.Error()
+		}
+		if scheduler.IsStopping() {
+			return
+		}
+		run.FinishedAt = time.Now()
+		task.Stats.Record(run.Status)
+		scheduler.RecordRun(run)
+
+		log.Warnf("Streaming command for collector %s exited (status: %s), restarting in %s",
+			task.Name, run.Status, task.RestartDelay)
+		if !scheduler.Sleep(task.RestartDelay) {
+			return
+		}
+	}
+}
+
+// Stream runs the task command until it exits, storing every output line as soon as it is
+// read, with the time it was read at.
+func (task *SchedulerTask) Stream(output *RotatingFile, runID string) error {
+	argv, gate, err := task.LimitedCommandArgs()
+	if err != nil {
+		return err
+	}
+	cmd := ExecCommand(argv[0], argv[1:]...)
+	cmd.Dir = task.BaseDir
+	cmd.SysProcAttr = task.SysProcAttr()
+	gate.Attach(cmd)
+	defer gate.Open()
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if task.Config.MergeStderr {
+		cmd.Stderr = cmd.Stdout
+	} else {
+		stderr, err := os.OpenFile(filepath.Join(task.BaseDir, task.Name+StreamStderrSuffix),
+			os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0750)
+		if err != nil {
+			return err
+		}
+		defer stderr.Close()
+		cmd.Stderr = stderr
+	}
+
+	log.Infof("Starting streaming command for collector %s", task.Name)
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	defer task.TrackProcessGroup(cmd.Process.Pid)()
+	defer task.ApplyLimits(gate, cmd.Process.Pid)()
+
+	scanner := bufio.NewScanner(stdout)
+	scanner.Buffer(make([]byte, 64*1024), MaxStreamLineSize)
+	for scanner.Scan() {
+		line, readAt := scanner.Text(), time.Now()
+		switch task.Config.Store {
+		case "database":
+			if err := task.StoreLineToDB(line, RowContext{RunID: runID, CollectedAt: readAt}); err != nil {
+				log.Debugf("Collector %s, skipping streamed line: %s", task.Name, err)
+			}
+		case "file":
+			if err := output.WriteLine(readAt, line); err != nil {
+				log.Errorf("Error storing streamed results for %s: %s", task.Name, err)
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		log.Errorf("Error reading output of streaming collector %s: %s", task.Name, err)
+		KillProcessGroup(cmd.Process.Pid, syscall.SIGKILL)
+	}
+	return cmd.Wait()
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestStreamStoresTimestampedLines(t *testing.T) {
+	dir, err := ioutil.TempDir("", DEFAULT_REPORT_PREFIX)
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	task := &SchedulerTask{Name: "vmstat", Command: "echo one; echo two; echo warn >&2", BaseDir: dir}
+	task.Config.Store = "file"
+
+	output := NewRotatingFile(dir, task.Name, 0)
+	assert.Nil(t, task.Stream(output, ""))
+	assert.Nil(t, output.Close())
+
+	files, _ := filepath.Glob(filepath.Join(dir, "vmstat-2*"))
+	assert.Len(t, files, 1)
+	content, _ := ioutil.ReadFile(files[0])
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	assert.Len(t, lines, 2)
+	assert.True(t, strings.HasSuffix(lines[0], " one"))
+	assert.True(t, strings.HasSuffix(lines[1], " two"))
+
+	stderr, _ := ioutil.ReadFile(filepath.Join(dir, task.Name+StreamStderrSuffix))
+	assert.Equal(t, "warn\n", string(stderr))
+}
+
+func TestParseSize(t *testing.T) {
+	for size, expected := range map[string]int64{"512": 512, "64KB": 64 << 10, "10MB": 10 << 20, "1g": 1 << 30} {
+		parsed, err := ParseSize(size)
+		assert.Nil(t, err)
+		assert.Equal(t, expected, parsed)
+	}
+	_, err := ParseSize("ten megabytes")
+	assert.Error(t, err)
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+)
+
+// TaskTable is a table populated by a collector, with the lines of the output it
+// stores (every line when Match is nil) and how they are mapped into columns.
+type TaskTable struct {
+	Name      string
+	Match     *regexp.Regexp
+	MapValues MapValue
+	Indexes   []IndexConfig
+	Changes   *ChangeTracker
+}
+
+// NewTaskTables returns the tables of a collection, the single table named after the
+// collection unless the database tables are defined.
+func NewTaskTables(tableName string, config DBConfig) ([]*TaskTable, error) {
+	if len(config.Tables) == 0 {
+		changes, err := NewChangeTracker(config.Changes)
+		if err != nil {
+			return nil, err
+		}
+		indexes := maintenanceIndexes(config.Indexes, config.HasMaintenance())
+		return []*TaskTable{{Name: tableName, MapValues: config.MapValues, Indexes: indexes, Changes: changes}}, nil
+	}
+
+	var tables []*TaskTable
+	for _, table := range config.Tables {
+		changes, err := NewChangeTracker(table.Changes)
+		if err != nil {
+			return nil, err
+		}
+		maintained := config.Retention != ""
+		for _, rollup := range config.Rollup {
+			maintained = maintained || strings.EqualFold(rollup.Table, table.Name)
+		}
+		taskTable := TaskTable{Name: strings.ToLower(table.Name), MapValues: table.MapValues,
+			Indexes: maintenanceIndexes(table.Indexes, maintained), Changes: changes}
+		if table.Match != "" {
+			match, err := regexp.Compile(table.Match)
+			if err != nil {
+				return nil, err
+			}
+			taskTable.Match = match
+		}
+		tables = append(tables, &taskTable)
+	}
+	return tables, nil
+}
+
+// maintenanceIndexes adds an index on created_at to the indexes of a table with retention
+// or rollups, which select its rows by collection time, unless an index starts with it.
+func maintenanceIndexes(indexes []IndexConfig, maintained bool) []IndexConfig {
+	if !maintained {
+		return indexes
+	}
+	for _, index := range indexes {
+		if len(index.Columns) > 0 && index.Columns[0] == "created_at" {
+			return indexes
+		}
+	}
+	return append(append([]IndexConfig{}, indexes...), IndexConfig{Columns: []string{"created_at"}})
+}
+
+// DBTables returns the tables the collector results are stored on, tasks not created by
+// NewSchedulerTask store them on the table named after the collection.
+func (task *SchedulerTask) DBTables() []*TaskTable {
+	if len(task.Tables) > 0 {
+		return task.Tables
+	}
+	return []*TaskTable{{Name: task.TableName(), MapValues: task.Config.Database.MapValues, Indexes: task.Config.Database.Indexes}}
+}
+
+func (task *SchedulerTask) TableNames() string {
+	var names []string
+	for _, table := range task.DBTables() {
+		names = append(names, table.Name)
+	}
+	return strings.Join(names, ", ")
+}